@@ -0,0 +1,129 @@
+// goos-bundle is the host-side tool that creates and signs GOOS bundles:
+// the ISO's boot files and update bundles served to goos-update.
+//
+//	goos-bundle keygen -out build/bundle
+//	goos-bundle sign -key build/bundle.key -version 1.2.0 DIR [FILE...]
+//	goos-bundle verify -pub build/bundle.pub DIR
+//
+// sign writes manifest.json and manifest.sig into DIR. FILEs default to
+// vmlinuz and initramfs.cpio, plus entry.conf when DIR has one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vpereira/goos/internal/bundle"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("goos-bundle: ")
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+	var err error
+	switch os.Args[1] {
+	case "keygen":
+		err = keygen(args)
+	case "sign":
+		err = sign(args)
+	case "verify":
+		err = verify(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: goos-bundle keygen|sign|verify [flags] ...")
+	os.Exit(2)
+}
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "bundle", "Key path prefix; writes PREFIX.key and PREFIX.pub")
+	_ = fs.Parse(args)
+	pub, priv, err := bundle.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".key", priv, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(*out+".pub", pub, 0o644)
+}
+
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "Private key file")
+	version := fs.String("version", "", "Bundle version")
+	_ = fs.Parse(args)
+	if *keyPath == "" || fs.NArg() < 1 {
+		return fmt.Errorf("usage: goos-bundle sign -key KEY -version VERSION DIR [FILE...]")
+	}
+	priv, err := bundle.LoadPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	dir := fs.Arg(0)
+	names := fs.Args()[1:]
+	if len(names) == 0 {
+		names = defaultFiles(dir)
+	}
+	raw, err := bundle.Create(dir, *version, names)
+	if err != nil {
+		return err
+	}
+	if _, err := bundle.Parse(raw); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundle.ManifestName), raw, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, bundle.SignatureName), bundle.Sign(priv, raw), 0o644)
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pubPath := fs.String("pub", "", "Public key file")
+	_ = fs.Parse(args)
+	if *pubPath == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: goos-bundle verify -pub KEY DIR")
+	}
+	pub, err := bundle.LoadPublicKey(*pubPath)
+	if err != nil {
+		return err
+	}
+	dir := fs.Arg(0)
+	m, err := bundle.VerifyDir(pub, dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := bundle.VerifyDir(pub, dir, names...); err != nil {
+		return err
+	}
+	fmt.Printf("%s: version %s, %d files OK\n", dir, m.Version, len(names))
+	return nil
+}
+
+func defaultFiles(dir string) []string {
+	names := []string{bundle.KernelName, bundle.InitrdName}
+	if _, err := os.Stat(filepath.Join(dir, bundle.EntryName)); err == nil {
+		names = append(names, bundle.EntryName)
+	}
+	return names
+}
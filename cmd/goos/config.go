@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/passwd"
+	"github.com/vpereira/goos/internal/secrets"
+)
+
+// hidden keys are never printed; secrets stay sealed on the ESP.
+var hidden = append([]string{secrets.ConfigKey, "root_password", "root_password_hash"}, secrets.Keys...)
+
+func configPath() (string, error) {
+	path := filepath.Join(config.ESPMount, config.Path)
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.New("no installed config (live boot?)")
+	}
+	return path, nil
+}
+
+// configGet prints the installed config, or only the given keys.
+func configGet(keys []string) (any, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		keys = cfg.Keys()
+	}
+	out := map[string]string{}
+	for _, k := range keys {
+		v, ok := cfg[k]
+		if !ok {
+			continue
+		}
+		if slices.Contains(hidden, k) {
+			v = secrets.Redact(v)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+type configSetResult struct {
+	Updated        []string `json:"updated"`
+	Removed        []string `json:"removed,omitempty"`
+	RebootRequired bool     `json:"reboot_required"`
+}
+
+// configSet updates key=value pairs in the installed config; an empty
+// value removes the key. Changes apply on the next boot.
+func configSet(args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("usage: goos config set key=value...")
+	}
+	// A key with only config.set must not be able to grant itself more.
+	_, restricted := os.LookupEnv("GOOS_SSH_ALLOWED")
+	set := config.Config{}
+	var del []string
+	for _, a := range args {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok || k == "" || strings.ContainsAny(k, " \t\n") || strings.Contains(v, "\n") {
+			return nil, fmt.Errorf("invalid setting %q", a)
+		}
+		if restricted && !restrictedSettable(k) {
+			return nil, fmt.Errorf("%s: not permitted for this key", k)
+		}
+		switch k {
+		case secrets.ConfigKey, "root_password_hash":
+			return nil, fmt.Errorf("%s cannot be set directly", k)
+		case "root_password":
+			if v == "" {
+				del = append(del, "root_password_hash")
+				continue
+			}
+			h, err := passwd.Hash(v)
+			if err != nil {
+				return nil, err
+			}
+			k, v = "root_password_hash", h
+		}
+		if v == "" {
+			del = append(del, k)
+			continue
+		}
+		set[k] = v
+	}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Update(path, set, del...); err != nil {
+		return nil, err
+	}
+	res := &configSetResult{Updated: set.Keys(), Removed: del, RebootRequired: true}
+	if res.Updated == nil {
+		res.Updated = []string{}
+	}
+	kmsg(fmt.Sprintf("config set %s", strings.Join(append(set.Keys(), del...), ",")))
+	return res, nil
+}
+
+// restrictedKeys are the settings a caller limited by an ssh_command_acl
+// may change. None of them decides who logs in, what they may run or
+// where the node takes its metadata and updates from.
+var restrictedKeys = []string{"hostname", "network", "static_ipv4", "static_gw", "static_dns"}
+
+// restrictedSettable reports whether a restricted caller may set k.
+func restrictedSettable(k string) bool {
+	return slices.Contains(restrictedKeys, k) && !secrets.Privileged(k)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestConfigSetRestricted(t *testing.T) {
+	t.Setenv("GOOS_SSH_ALLOWED", "config.set")
+	for _, k := range []string{
+		"ssh_key.evil",
+		"ssh_command_acl.evil",
+		"ssh_password_auth",
+		"root_password",
+		"root_password_hash",
+		"metadata",
+		"update_url",
+		"update_allow_downgrade",
+		"update_enabled",
+		"secrets",
+		"join_token",
+		"master_url",
+		"role",
+	} {
+		_, err := configSet([]string{"hostname=node1", k + "=x"})
+		if err == nil || err.Error() != k+": not permitted for this key" {
+			t.Errorf("set %s: %v", k, err)
+		}
+	}
+	// Checking happens before the config is opened; the allowed keys are
+	// only checked here so the test never writes an installed config.
+	for _, k := range restrictedKeys {
+		if !restrictedSettable(k) {
+			t.Errorf("%s not settable", k)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type logRecord struct {
+	Seq      uint64 `json:"seq"`
+	TimeUS   uint64 `json:"time_us"`
+	Priority int    `json:"priority"`
+	Message  string `json:"message"`
+}
+
+// logs prints the last -n kernel log records, which include everything
+// goos-init and goos-sshd log.
+func logs(args []string) (any, error) {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	n := fs.Int("n", 100, "number of records")
+	fs.SetOutput(new(strings.Builder))
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	// Raw syscalls: an *os.File would wait in the poller instead of
+	// returning EAGAIN at the end of the buffer.
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/kmsg", Err: err}
+	}
+	defer syscall.Close(fd)
+	records := []logRecord{}
+	buf := make([]byte, 8192)
+	for {
+		m, err := syscall.Read(fd, buf)
+		if err == syscall.EAGAIN {
+			break
+		}
+		// EPIPE: the record was overwritten while we read; go on.
+		if err == syscall.EPIPE || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "read", Path: "/dev/kmsg", Err: err}
+		}
+		if r, ok := parseKmsg(string(buf[:m])); ok {
+			records = append(records, r)
+		}
+	}
+	if *n > 0 && len(records) > *n {
+		records = records[len(records)-*n:]
+	}
+	return records, nil
+}
+
+// parseKmsg parses a /dev/kmsg record: "prio,seq,usec,flags;message"
+// followed by optional continuation lines.
+func parseKmsg(s string) (logRecord, bool) {
+	head, msg, ok := strings.Cut(s, ";")
+	if !ok {
+		return logRecord{}, false
+	}
+	f := strings.Split(head, ",")
+	if len(f) < 3 {
+		return logRecord{}, false
+	}
+	prio, _ := strconv.Atoi(f[0])
+	seq, _ := strconv.ParseUint(f[1], 10, 64)
+	us, _ := strconv.ParseUint(f[2], 10, 64)
+	msg, _, _ = strings.Cut(msg, "\n")
+	return logRecord{Seq: seq, TimeUS: us, Priority: prio & 7, Message: msg}, true
+}
@@ -0,0 +1,90 @@
+// goos is the management command for automation. It is meant to be run
+// over SSH, as an exec target ("ssh node goos status") or as a forced
+// command that reads SSH_ORIGINAL_COMMAND, and always prints JSON.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// command is a subcommand. perm is the permission an SSH command ACL must
+// grant to run it.
+type command struct {
+	perm string
+	run  func(args []string) (any, error)
+}
+
+var commands = map[string]command{
+	"status":     {"status", status},
+	"config get": {"config.get", configGet},
+	"config set": {"config.set", configSet},
+	"reboot":     {"reboot", reboot},
+	"logs":       {"logs", logs},
+	"services":   {"services", listServices},
+	"upgrade":    {"upgrade", upgrade},
+}
+
+const usage = "usage: goos status | config get [key...] | config set key=value... | reboot | logs [-n N] | services | upgrade"
+
+func main() {
+	v, err := run(os.Args[1:])
+	if err != nil {
+		write(map[string]string{"error": err.Error()})
+		os.Exit(1)
+	}
+	write(v)
+}
+
+func run(args []string) (any, error) {
+	// As a forced command, the client's command line arrives here.
+	if len(args) == 0 {
+		if orig := os.Getenv("SSH_ORIGINAL_COMMAND"); orig != "" {
+			args = strings.Fields(orig)
+			if path.Base(args[0]) == "goos" {
+				args = args[1:]
+			}
+		}
+	}
+	if len(args) == 0 {
+		return nil, errors.New(usage)
+	}
+	name := args[0]
+	args = args[1:]
+	if name == "config" && len(args) > 0 {
+		name += " " + args[0]
+		args = args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return nil, errors.New(usage)
+	}
+	if !permitted(cmd.perm) {
+		return nil, fmt.Errorf("%s: not permitted for this key", name)
+	}
+	return cmd.run(args)
+}
+
+// permitted checks perm against the command ACL goos-sshd passes for
+// restricted keys and principals. Without one everything is allowed, as
+// for a local root shell.
+func permitted(perm string) bool {
+	acl, ok := os.LookupEnv("GOOS_SSH_ALLOWED")
+	if !ok {
+		return true
+	}
+	group, _, _ := strings.Cut(perm, ".")
+	allowed := strings.Split(acl, ",")
+	return slices.Contains(allowed, "*") || slices.Contains(allowed, perm) || slices.Contains(allowed, group)
+}
+
+func write(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
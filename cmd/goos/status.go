@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/secrets"
+	"github.com/vpereira/goos/internal/services"
+)
+
+// hostKeyFingerprints is written by goos-init at boot.
+const hostKeyFingerprints = "/run/goos/ssh_host_fingerprints"
+
+type statusInfo struct {
+	Hostname      string              `json:"hostname"`
+	Kernel        string              `json:"kernel"`
+	Uptime        float64             `json:"uptime_seconds"`
+	Load          [3]float64          `json:"load"`
+	MemTotalKB    int64               `json:"mem_total_kb"`
+	MemAvailKB    int64               `json:"mem_available_kb"`
+	Installed     bool                `json:"installed"`
+	BootSlot      string              `json:"boot_slot,omitempty"`
+	Addresses     map[string][]string `json:"addresses"`
+	SSHHostKeys   []string            `json:"ssh_host_keys"`
+	Services      []services.Status   `json:"services"`
+	Time          time.Time           `json:"time"`
+	KernelCmdline string              `json:"cmdline"`
+}
+
+func status([]string) (any, error) {
+	s := &statusInfo{Addresses: map[string][]string{}, Time: time.Now().UTC()}
+	s.Hostname, _ = os.Hostname()
+	var u syscall.Utsname
+	if syscall.Uname(&u) == nil {
+		s.Kernel = utsString(u.Release[:])
+	}
+	var si syscall.Sysinfo_t
+	if syscall.Sysinfo(&si) == nil {
+		s.Uptime = float64(si.Uptime)
+		for i := range s.Load {
+			s.Load[i] = float64(si.Loads[i]) / (1 << 16)
+		}
+	}
+	s.MemTotalKB, s.MemAvailKB = meminfo()
+	_, err := os.Stat(filepath.Join(config.ESPMount, config.Path))
+	s.Installed = err == nil
+	s.BootSlot, _ = cmdline.Value("goos.slot")
+	if ifs, err := net.Interfaces(); err == nil {
+		for _, ifc := range ifs {
+			addrs, _ := ifc.Addrs()
+			for _, a := range addrs {
+				s.Addresses[ifc.Name] = append(s.Addresses[ifc.Name], a.String())
+			}
+		}
+	}
+	if b, err := os.ReadFile(hostKeyFingerprints); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if line != "" {
+				s.SSHHostKeys = append(s.SSHHostKeys, line)
+			}
+		}
+	}
+	s.Services, _ = services.List()
+	if b, err := os.ReadFile("/proc/cmdline"); err == nil {
+		s.KernelCmdline = redactCmdline(string(b))
+	}
+	return s, nil
+}
+
+// redactCmdline hides the values of options that carry secrets: the disk
+// key in goos.secret=, and URLs that may embed tokens or credentials.
+func redactCmdline(line string) string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if ok && sensitiveOption(k) {
+			fields[i] = k + "=" + secrets.Redact(v)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func sensitiveOption(k string) bool {
+	switch k {
+	case "goos.secret", "goos.metadata", "goos.autoinstall":
+		return true
+	}
+	k = strings.ToLower(k)
+	for _, s := range []string{"secret", "password", "passwd", "token", "key"} {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func utsString(b []int8) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		sb.WriteByte(byte(c))
+	}
+	return sb.String()
+}
+
+func meminfo() (total, avail int64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = n
+		case "MemAvailable:":
+			avail = n
+		}
+	}
+	return total, avail
+}
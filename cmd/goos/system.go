@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/services"
+)
+
+// updateConfig is written by goos-init when the update agent runs.
+const updateConfig = "/run/goos/update.conf"
+
+func listServices([]string) (any, error) {
+	list, err := services.List()
+	if list == nil {
+		list = []services.Status{}
+	}
+	return list, err
+}
+
+// reboot restarts the node once the reply has gone out.
+func reboot([]string) (any, error) {
+	kmsg("reboot")
+	write(map[string]bool{"rebooting": true})
+	os.Stdout.Close()
+	syscall.Sync()
+	time.Sleep(time.Second)
+	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART); err != nil {
+		return nil, err
+	}
+	select {}
+}
+
+// upgrade checks for an update bundle now and stages it. The agent
+// reboots into it in the maintenance window.
+func upgrade([]string) (any, error) {
+	if _, err := os.Stat(updateConfig); err != nil {
+		return nil, errors.New("upgrade: update agent not configured on this node")
+	}
+	kmsg("upgrade")
+	var stderr strings.Builder
+	cmd := exec.Command("goos-update", "-config", updateConfig, "-once")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	var res any
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// kmsg logs an action to the kernel log with the SSH identity that asked
+// for it, as set by goos-sshd.
+func kmsg(action string) {
+	who := []string{}
+	for _, k := range []string{"GOOS_SSH_CLIENT_IP", "GOOS_SSH_KEY_FP", "GOOS_SSH_PRINCIPAL"} {
+		if v := os.Getenv(k); v != "" {
+			who = append(who, v)
+		}
+	}
+	msg := "goos: " + action
+	if len(who) > 0 {
+		msg += " by " + strings.Join(who, " ")
+	}
+	_ = os.WriteFile("/dev/kmsg", []byte(msg+"\n"), 0o644)
+}
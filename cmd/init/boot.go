@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/services"
+	"github.com/vpereira/goos/internal/slots"
+)
+
+// blessDelay gives services time to crash before a boot counts as good.
+const blessDelay = 30 * time.Second
+
+// blessBoot drops the boot counter from the booted slot's loader entry
+// once the node has stayed healthy for delay. An unhealthy boot of a slot
+// still on trial is rebooted, so systemd-boot uses up its tries and falls
+// back to the other slot. BIOS boots of a hybrid install and the slot's
+// boot partition follow the blessed slot.
+func blessBoot(delay time.Duration) {
+	slot, ok := cmdline.Value("goos.slot")
+	if !ok || !espMounted() {
+		return
+	}
+	repairSlot(slots.Other(slot))
+	e, ok := slots.Find(config.ESPMount, slot)
+	if !ok {
+		log("goos: no loader entry for booted slot " + slot)
+		return
+	}
+	if !e.Counting {
+		log("goos: booted slot " + slot)
+		pointSyslinux(slot)
+		backupSlot(slot)
+		return
+	}
+	log("goos: booted slot " + slot + " on trial")
+	time.Sleep(delay)
+	if err := healthCheck(slot); err != nil {
+		log("goos: slot " + slot + " unhealthy: " + err.Error() + "; rebooting")
+		syscall.Sync()
+		_ = syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+		return
+	}
+	if _, err := slots.Bless(config.ESPMount, slot); err != nil {
+		log("goos: bless slot " + slot + ": " + err.Error())
+		return
+	}
+	pointSyslinux(slot)
+	syscall.Sync()
+	log("goos: blessed slot " + slot)
+	backupSlot(slot)
+}
+
+func pointSyslinux(slot string) {
+	changed, err := slots.PointSyslinux(config.ESPMount, slot)
+	if err != nil {
+		log("goos: syslinux: " + err.Error())
+		return
+	}
+	if changed {
+		syscall.Sync()
+		log("goos: BIOS boots slot " + slot)
+	}
+}
+
+// healthCheck decides whether this boot is good: the slot's files match
+// its signed manifest, the requested root was switched into and no service
+// has failed.
+func healthCheck(slot string) error {
+	if err := verifySlot(slot); err != nil {
+		return err
+	}
+	if spec, ok := parseRoot(); ok && spec.source != autoRoot && inInitramfs() {
+		return errors.New("still in initramfs")
+	}
+	list, _ := services.List()
+	for _, s := range list {
+		if s.State == services.Failed {
+			return errors.New(s.Name + " failed: " + s.Detail)
+		}
+	}
+	return nil
+}
+
+// verifySlot checks the slot's kernel and initramfs on the ESP against the
+// signed manifest written with them, when the initramfs has a trust root.
+func verifySlot(slot string) error {
+	if err := verifyDir(filepath.Join(config.ESPMount, slots.Dir(slot))); err != nil {
+		return errors.New("slot " + slot + " files: " + err.Error())
+	}
+	return nil
+}
+
+func verifyDir(dir string) error {
+	pub, err := bundle.LoadPublicKey(bundle.TrustRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = bundle.VerifyDir(pub, dir, bundle.KernelName, bundle.InitrdName)
+	return err
+}
+
+// bootPartitionDir is where a slot's boot partition is mounted while files
+// are copied to or from it.
+const bootPartitionDir = "/run/goos/boot"
+
+// withBootPartition mounts slot's boot partition from the boot disk and
+// runs fn on it. It reports false when the layout has none.
+func withBootPartition(slot string, fn func(dir string) error) (bool, error) {
+	p, ok := findBootPartition(slots.Partition(slot))
+	if !ok {
+		return false, nil
+	}
+	_ = os.MkdirAll(bootPartitionDir, 0o755)
+	if err := syscall.Mount(p.dev, bootPartitionDir, "vfat", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return true, err
+	}
+	err := fn(bootPartitionDir)
+	syscall.Sync()
+	if uerr := syscall.Unmount(bootPartitionDir, 0); err == nil {
+		err = uerr
+	}
+	return true, err
+}
+
+// backupSlot copies the blessed slot's files to its boot partition unless
+// the partition already holds them. Files that fail verification are not
+// copied.
+func backupSlot(slot string) {
+	esp := filepath.Join(config.ESPMount, slots.Dir(slot))
+	copied := false
+	found, err := withBootPartition(slot, func(dir string) error {
+		if sameManifest(esp, dir) {
+			return nil
+		}
+		if err := verifySlot(slot); err != nil {
+			return err
+		}
+		copied = true
+		return slots.CopyFiles(esp, dir)
+	})
+	switch {
+	case !found:
+	case err != nil:
+		log("goos: back up slot " + slot + ": " + err.Error())
+	case copied:
+		log("goos: backed up slot " + slot + " to " + slots.Partition(slot))
+	}
+}
+
+// repairSlot restores a blessed slot's ESP files from its boot partition
+// when they no longer match their signed manifest, so the slot stays a
+// good fallback. Slots on trial are left to systemd-boot's boot counting.
+func repairSlot(slot string) {
+	e, ok := slots.Find(config.ESPMount, slot)
+	if !ok || e.Counting {
+		return
+	}
+	verr := verifySlot(slot)
+	if verr == nil {
+		return
+	}
+	esp := filepath.Join(config.ESPMount, slots.Dir(slot))
+	found, err := withBootPartition(slot, func(dir string) error {
+		if err := verifyDir(dir); err != nil {
+			return errors.New(slots.Partition(slot) + ": " + err.Error())
+		}
+		return slots.CopyFiles(dir, esp)
+	})
+	switch {
+	case !found:
+		log("goos: " + verr.Error() + "; no boot partition to repair it from")
+	case err != nil:
+		log("goos: " + verr.Error() + "; repair failed: " + err.Error())
+	default:
+		log("goos: " + verr.Error() + "; restored from " + slots.Partition(slot))
+	}
+}
+
+// sameManifest reports whether the directories hold the same manifest.
+func sameManifest(a, b string) bool {
+	x, err := os.ReadFile(filepath.Join(a, bundle.ManifestName))
+	if err != nil {
+		return false
+	}
+	y, err := os.ReadFile(filepath.Join(b, bundle.ManifestName))
+	return err == nil && bytes.Equal(x, y)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/layout"
+	"github.com/vpereira/goos/internal/passwd"
+	"golang.org/x/sys/unix"
+)
+
+// loadConfig mounts the ESP written by goos-installer and reads its config.
+// A live boot has no ESP, so an empty config is returned in that case.
+func loadConfig() config.Config {
+	if !mountESP() {
+		return config.Config{}
+	}
+	cfg, err := config.Load(filepath.Join(config.ESPMount, config.Path))
+	if err != nil {
+		log("goos: read config: " + err.Error())
+		return config.Config{}
+	}
+	log("goos: loaded config from ESP")
+	migrateConfig(cfg)
+	unsealSecrets(cfg)
+	return cfg
+}
+
+// migrateConfig upgrades configs written by older installers in place.
+// Those stored root_password in plaintext; it is replaced by its hash.
+func migrateConfig(cfg config.Config) {
+	plain, ok := cfg["root_password"]
+	if !ok || cfg.Get("root_password_hash") != "" {
+		return
+	}
+	hash := ""
+	if plain != "" {
+		h, err := passwd.Hash(plain)
+		if err != nil {
+			log("goos: hash root password: " + err.Error())
+			return
+		}
+		hash = h
+	}
+	path := filepath.Join(config.ESPMount, config.Path)
+	if err := config.Update(path, config.Config{"root_password_hash": hash}, "root_password"); err != nil {
+		log("goos: migrate root_password: " + err.Error())
+		return
+	}
+	delete(cfg, "root_password")
+	cfg["root_password_hash"] = hash
+	log("goos: replaced plaintext root_password with root_password_hash")
+}
+
+// mountESP mounts the first vfat partition holding an installer config.
+func mountESP() bool {
+	loadModules(
+		"fs/fat/fat.ko",
+		"fs/fat/vfat.ko",
+		"fs/nls/nls_cp437.ko",
+		"fs/nls/nls_iso8859-1.ko",
+	)
+	_ = os.MkdirAll(config.ESPMount, 0o755)
+	for _, part := range blockPartitions() {
+		dev := filepath.Join("/dev", part)
+		if err := syscall.Mount(dev, config.ESPMount, "vfat", 0, ""); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(config.ESPMount, config.Path)); err == nil {
+			log("goos: mounted ESP " + dev + " at " + config.ESPMount)
+			return true
+		}
+		_ = syscall.Unmount(config.ESPMount, 0)
+	}
+	return false
+}
+
+func espMounted() bool {
+	_, err := os.Stat(filepath.Join(config.ESPMount, config.Path))
+	return err == nil
+}
+
+// bootDisk returns the whole disk, e.g. sda, that the mounted ESP is on.
+// GOOS only touches partitions on that disk.
+func bootDisk() (string, bool) {
+	if !espMounted() {
+		return "", false
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(config.ESPMount, &st); err != nil {
+		return "", false
+	}
+	// /sys/dev/block/MAJ:MIN links to .../block/<disk>/<partition>.
+	link := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev))
+	path, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(path, "partition")); err != nil {
+		return "", false
+	}
+	return filepath.Base(filepath.Dir(path)), true
+}
+
+// blockPartitions lists partition names, ESP-labelled ones first.
+func blockPartitions() []string {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return nil
+	}
+	var esp, rest []string
+	for _, e := range entries {
+		name := e.Name()
+		if _, err := os.Stat(filepath.Join("/sys/class/block", name, "partition")); err != nil {
+			continue
+		}
+		if ueventValue(name, "PARTNAME") == layout.ESPName {
+			esp = append(esp, name)
+		} else {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(esp)
+	sort.Strings(rest)
+	return append(esp, rest...)
+}
+
+func ueventValue(block, key string) string {
+	b, err := os.ReadFile(filepath.Join("/sys/class/block", block, "uevent"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// applyConfig applies the settings goos-init owns directly. sshd settings
+// are handled by startSSHD.
+func applyConfig(cfg config.Config) {
+	if h := cfg.Get("hostname"); h != "" {
+		if err := syscall.Sethostname([]byte(h)); err != nil {
+			log("goos: set hostname: " + err.Error())
+		} else {
+			log("goos: hostname " + h)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vpereira/goos/internal/config"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// hostKeyDir holds per-node SSH host keys, relative to the ESP.
+	hostKeyDir = "/goos/ssh"
+	// hostKeyFingerprints lists the fingerprints for the guest agent and
+	// anything else that wants them without parsing the console.
+	hostKeyFingerprints = "/run/goos/ssh_host_fingerprints"
+)
+
+// hostKeyTypes are generated on first boot; RSA is kept for older clients.
+var hostKeyTypes = []string{"ed25519", "rsa"}
+
+// ensureHostKeys loads this node's SSH host keys, generating them on first
+// boot. Keys persist on the ESP; a live boot without one gets keys that
+// only last until reboot. It returns the private key paths.
+func ensureHostKeys() []string {
+	dir := filepath.Join(config.ESPMount, hostKeyDir)
+	if !espMounted() {
+		dir = "/run/goos/ssh"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log("goos: ssh host keys: " + err.Error())
+		return nil
+	}
+	var paths []string
+	var fps strings.Builder
+	for _, typ := range hostKeyTypes {
+		path := filepath.Join(dir, "ssh_host_"+typ+"_key")
+		pub, err := loadHostKey(path)
+		if err != nil {
+			log("goos: generating ssh host key " + typ)
+			if pub, err = generateHostKey(path, typ); err != nil {
+				log("goos: ssh host key " + typ + ": " + err.Error())
+				continue
+			}
+		}
+		paths = append(paths, path)
+		line := fmt.Sprintf("%s %s", pub.Type(), ssh.FingerprintSHA256(pub))
+		log("goos: ssh host key " + line)
+		fps.WriteString(line + "\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(hostKeyFingerprints), 0o755); err == nil {
+		_ = os.WriteFile(hostKeyFingerprints, []byte(fps.String()), 0o644)
+	}
+	return paths
+}
+
+func loadHostKey(path string) (ssh.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+func generateHostKey(path, typ string) (ssh.PublicKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch typ {
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "goos host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, err
+	}
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pub), 0o644); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/passwd"
+	"github.com/vpereira/goos/internal/services"
+	"golang.org/x/term"
+)
+
+// consoleTTYs are the terminals that get a login prompt.
+var consoleTTYs = []string{"ttyS0", "tty1"}
+
+// startConsoles runs a login prompt on every console tty. An empty root
+// password disables console login, as promised by the installer.
+func startConsoles(cfg config.Config) {
+	hash := rootPasswordHash(cfg)
+	if hash == "" {
+		log("goos: no root password set; console login disabled")
+		_ = services.Write(services.Status{Name: "console-login", State: services.Disabled})
+		return
+	}
+	for _, tty := range consoleTTYs {
+		go getty(tty, hash)
+	}
+	_ = services.Write(services.Status{
+		Name:    "console-login",
+		State:   services.Running,
+		PID:     os.Getpid(),
+		Started: time.Now(),
+		Detail:  strings.Join(consoleTTYs, ","),
+	})
+}
+
+// rootPasswordHash returns the configured SHA-512 crypt hash. A plaintext
+// root_password that survived migration (e.g. from user-data) is hashed
+// in memory.
+func rootPasswordHash(cfg config.Config) string {
+	if h := cfg.Get("root_password_hash"); h != "" {
+		if !passwd.IsHash(h) {
+			log("goos: root_password_hash is not a SHA-512 crypt hash; ignoring")
+			return ""
+		}
+		return h
+	}
+	plain := cfg.Get("root_password")
+	if plain == "" {
+		return ""
+	}
+	h, err := passwd.Hash(plain)
+	if err != nil {
+		log("goos: hash root password: " + err.Error())
+		return ""
+	}
+	return h
+}
+
+// getty owns one tty: prompt, authenticate, run a shell, repeat.
+func getty(tty, hash string) {
+	dev := "/dev/" + tty
+	for {
+		f, err := os.OpenFile(dev, os.O_RDWR, 0)
+		if err != nil {
+			log("goos: getty " + tty + ": " + err.Error())
+			return
+		}
+		if login(f, hash) {
+			log("goos: root login on " + tty)
+			if err := loginShell(f); err != nil {
+				log("goos: getty " + tty + ": shell: " + err.Error())
+				time.Sleep(time.Second)
+			}
+		}
+		_ = f.Close()
+	}
+}
+
+func login(f *os.File, hash string) bool {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "goos"
+	}
+	fmt.Fprintf(f, "\n%s login: ", host)
+	user, err := readTTYLine(f)
+	if err != nil {
+		// Nothing attached on the other end; don't spin.
+		time.Sleep(5 * time.Second)
+		return false
+	}
+	fmt.Fprint(f, "Password: ")
+	pw, err := term.ReadPassword(int(f.Fd()))
+	fmt.Fprintln(f)
+	if err == nil && user == "root" && passwd.Verify(hash, string(pw)) {
+		return true
+	}
+	time.Sleep(3 * time.Second)
+	fmt.Fprintln(f, "Login incorrect")
+	return false
+}
+
+// readTTYLine reads one line a byte at a time so nothing is buffered
+// past the newline before the terminal is switched to no-echo.
+func readTTYLine(f *os.File) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			continue
+		}
+		switch b[0] {
+		case '\n', '\r':
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+// loginShell runs gosh as a session leader with f as its controlling tty.
+func loginShell(f *os.File) error {
+	cmd := exec.Command(mustLookPath("gosh"))
+	cmd.Stdin = f
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.Env = os.Environ()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	return cmd.Run()
+}
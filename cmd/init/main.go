@@ -10,6 +10,9 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/services"
 )
 
 func main() {
@@ -26,10 +29,20 @@ func main() {
 
 	log("goos: init starting")
 
-	// Mount basics (ignore errors if already mounted by kernel).
+	// Mount basics. After switch_root they were moved across, and /run
+	// keeps the root overlay's upper layer and earlier state, so mounts
+	// already in place are kept.
 	mount("proc", "/proc", "proc", 0, "")
 	mount("sysfs", "/sys", "sysfs", 0, "")
 	mount("devtmpfs", "/dev", "devtmpfs", 0, "mode=0755")
+	mount("tmpfs", "/run", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+
+	// An installed root or root image named by goos.root= takes over from
+	// here.
+	switchRoot()
+
+	// fw_cfg may carry the key for sealed secrets.
+	loadModules("drivers/firmware/qemu_fw_cfg.ko")
 
 	if bootInstaller() {
 		cmd := exec.Command("goos-installer")
@@ -42,9 +55,10 @@ func main() {
 		log("goos: installer finished; starting shell")
 	}
 
-	ensureAuthorizedKeys()
+	cfg := loadConfig()
+	mountState()
+	enableSwap()
 	startGuestAgent()
-	startSSHD()
 
 	// Bring up loopback + first NIC.
 	_ = run("ip", "link", "set", "lo", "up")
@@ -101,28 +115,49 @@ func main() {
 
 		// Show addresses for debugging.
 		_ = run("ip", "addr", "show", iface)
+
+		cfg.Merge(loadMetadata(cfg))
 	}
 
+	applyConfig(cfg)
+	startSSHD(cfg)
+	startUpdateAgent(cfg)
+
 	// CI marker.
 	fmt.Println("READY")
 
-	b, _ := os.ReadFile("/proc/cmdline")
-	if strings.Contains(string(b), "goos.shell=0") {
-		log("goos: shell disabled via cmdline; idling")
-		return
-	}
-
-	if _, err := exec.LookPath("gosh"); err == nil {
-		log("goos: starting gosh (Ctrl+A X to exit QEMU -nographic)")
-		_ = syscall.Exec(mustLookPath("gosh"), []string{"gosh"}, os.Environ())
+	// goos.shell=1 is the passwordless emergency shell; without it the
+	// consoles only offer a login prompt.
+	if v, _ := cmdline.Value("goos.shell"); v == "1" {
+		if _, err := exec.LookPath("gosh"); err == nil {
+			// Exec ends every goroutine, so assess the boot first.
+			blessBoot(0)
+			log("goos: starting emergency gosh (Ctrl+A X to exit QEMU -nographic)")
+			_ = syscall.Exec(mustLookPath("gosh"), []string{"gosh"}, os.Environ())
+		}
 	}
+	go blessBoot(blessDelay)
+	startConsoles(cfg)
 }
 
 func mount(source, target, fstype string, flags uintptr, data string) {
+	if isMountPoint(target) {
+		return
+	}
 	_ = os.MkdirAll(target, 0o755)
 	_ = syscall.Mount(source, target, fstype, flags, data)
 }
 
+// isMountPoint reports whether path is on another filesystem than its
+// parent directory.
+func isMountPoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(path, &st) != nil || syscall.Stat(filepath.Dir(path), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
 func run(name string, args ...string) error {
 	return runCtx(context.Background(), name, args...)
 }
@@ -178,12 +213,31 @@ func kernelRelease() string {
 	return strings.TrimSpace(string(b))
 }
 
+// loadModules insmods modules given relative to /lib/modules/<kver>/kernel,
+// skipping any that are not shipped in the initramfs.
+func loadModules(rels ...string) {
+	kver := kernelRelease()
+	if kver == "" {
+		return
+	}
+	for _, rel := range rels {
+		p := filepath.Join("/lib/modules", kver, "kernel", rel)
+		if _, err := os.Stat(p); err == nil {
+			_ = run("insmod", p)
+		}
+	}
+}
+
 func bootInstaller() bool {
 	b, err := os.ReadFile("/proc/cmdline")
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(b), "goos.installer=1")
+	if strings.Contains(string(b), "goos.installer=1") {
+		return true
+	}
+	_, ok := cmdline.Value("goos.autoinstall")
+	return ok
 }
 
 // any other better qemu-guest-agent?
@@ -196,25 +250,29 @@ func startGuestAgent() {
 	cmd := exec.Command("qemu-guest-kragent")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	_ = cmd.Start()
+	startService("qemu-guest-agent", cmd)
 }
 
-// TODO: pass keys and authorized keys as params
-func startSSHD() {
-	if _, err := exec.LookPath("sshd"); err != nil {
+// startService starts a daemon, records it for "goos services" and reaps
+// it when it exits.
+func startService(name string, cmd *exec.Cmd) {
+	st := services.Status{Name: name, State: services.Running, Started: time.Now()}
+	if err := cmd.Start(); err != nil {
+		log("goos: " + name + ": " + err.Error())
+		st.State, st.Detail = services.Failed, err.Error()
+		_ = services.Write(st)
 		return
 	}
-	cmd := exec.Command("sshd", "-ip", "0.0.0.0", "-port", "2222", "-privatekey", "/id_rsa", "-keys", "/authorized_keys")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	_ = cmd.Start()
-}
-
-func ensureAuthorizedKeys() {
-	if _, err := os.Stat("/authorized_keys"); err == nil {
-		return
-	}
-	_ = os.WriteFile("/authorized_keys", []byte{}, 0o600)
+	st.PID = cmd.Process.Pid
+	_ = services.Write(st)
+	go func() {
+		st.State, st.Detail = services.Exited, "exit status 0"
+		if err := cmd.Wait(); err != nil {
+			st.State, st.Detail = services.Failed, err.Error()
+			log("goos: " + name + " exited: " + err.Error())
+		}
+		_ = services.Write(st)
+	}()
 }
 
 func log(s string) {
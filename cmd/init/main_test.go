@@ -0,0 +1,16 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIsMountPoint(t *testing.T) {
+	if !isMountPoint("/proc") {
+		t.Error("/proc is not a mount point")
+	}
+	dir := t.TempDir()
+	if isMountPoint(dir) || isMountPoint(filepath.Join(dir, "missing")) {
+		t.Errorf("%s is a mount point", dir)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/secrets"
+)
+
+// EC2/OpenStack style link-local metadata service.
+const (
+	metadataDefaultURL = "http://169.254.169.254"
+	metadataCache      = "/goos/metadata.json" // relative to the ESP
+	metadataAttempts   = 3
+	metadataTimeout    = 3 * time.Second
+)
+
+var errMetadataNotFound = errors.New("not found")
+
+type metadata struct {
+	InstanceID string   `json:"instance_id"`
+	Hostname   string   `json:"hostname"`
+	PublicKeys []string `json:"public_keys"`
+	UserData   string   `json:"user_data,omitempty"`
+}
+
+// metadataURL returns the service base URL, or "" when the datasource is
+// disabled with goos.metadata=0 or metadata=off in the config.
+func metadataURL(cfg config.Config) string {
+	v, ok := cmdline.Value("goos.metadata")
+	if !ok {
+		v = cfg.Get("metadata")
+	}
+	switch v {
+	case "", "1", "on", "auto":
+		return metadataDefaultURL
+	case "0", "off":
+		return ""
+	}
+	return strings.TrimRight(v, "/")
+}
+
+// loadMetadata queries the metadata service and returns its settings as a
+// config overlay. When the service is unreachable the copy cached on the
+// ESP from a previous boot is used instead.
+func loadMetadata(cfg config.Config) config.Config {
+	base := metadataURL(cfg)
+	if base == "" {
+		return nil
+	}
+	cache := ""
+	if espMounted() {
+		cache = filepath.Join(config.ESPMount, metadataCache)
+	}
+	md, ok := cachedMetadata(&http.Client{Timeout: metadataTimeout}, base, cache)
+	if !ok {
+		return nil
+	}
+	return md.config()
+}
+
+// cachedMetadata fetches the metadata and saves it to cache, or falls back
+// to the saved copy when the service does not answer. Without a cache path
+// nothing is saved or read back.
+func cachedMetadata(c *http.Client, base, cache string) (*metadata, bool) {
+	md, err := fetchMetadata(c, base)
+	if err != nil {
+		log("goos: metadata: " + err.Error())
+		if cache == "" {
+			return nil, false
+		}
+		if md, err = readMetadataCache(cache); err != nil {
+			return nil, false
+		}
+		log("goos: metadata: using cached copy")
+		return md, true
+	}
+	log("goos: metadata: instance " + md.InstanceID)
+	if cache != "" {
+		if err := writeMetadataCache(cache, md); err != nil {
+			log("goos: metadata: write cache: " + err.Error())
+		}
+	}
+	return md, true
+}
+
+// config maps metadata onto the keys used by the installer config.
+// User-data in key=value form is merged last so it wins, except for
+// privileged keys: anyone who can answer on the link-local address can
+// supply user-data, so those always come from the ESP config.
+func (md *metadata) config() config.Config {
+	cfg := config.Config{}
+	if md.InstanceID != "" {
+		cfg["instance_id"] = md.InstanceID
+	}
+	if md.Hostname != "" {
+		cfg["hostname"] = md.Hostname
+	}
+	for i, k := range md.PublicKeys {
+		cfg[fmt.Sprintf("ssh_key.metadata.%d", i)] = k
+	}
+	if strings.TrimSpace(md.UserData) != "" {
+		ud, err := config.Parse(strings.NewReader(md.UserData))
+		if err != nil {
+			log("goos: metadata: user-data is not a goos config; ignored: " + err.Error())
+		} else {
+			for _, k := range ud.Keys() {
+				if secrets.Privileged(k) {
+					log("goos: metadata: user-data cannot set " + k + "; ignored")
+					delete(ud, k)
+				}
+			}
+			cfg.Merge(ud)
+		}
+	}
+	return cfg
+}
+
+func fetchMetadata(c *http.Client, base string) (*metadata, error) {
+	// One quick probe so networks without a metadata service don't pay
+	// for the retries below.
+	resp, err := c.Get(base + "/")
+	if err != nil {
+		return nil, fmt.Errorf("no metadata service at %s: %w", base, err)
+	}
+	resp.Body.Close()
+
+	md, err := fetchOpenStack(c, base)
+	if err == nil {
+		return md, nil
+	}
+	return fetchEC2(c, base)
+}
+
+func fetchOpenStack(c *http.Client, base string) (*metadata, error) {
+	b, err := metadataGet(c, "GET", base+"/openstack/latest/meta_data.json", nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		UUID       string            `json:"uuid"`
+		Hostname   string            `json:"hostname"`
+		PublicKeys map[string]string `json:"public_keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parse meta_data.json: %w", err)
+	}
+	md := &metadata{InstanceID: doc.UUID, Hostname: doc.Hostname}
+	for _, k := range doc.PublicKeys {
+		md.PublicKeys = append(md.PublicKeys, strings.TrimSpace(k))
+	}
+	ud, err := metadataGet(c, "GET", base+"/openstack/latest/user_data", nil)
+	if err != nil && !errors.Is(err, errMetadataNotFound) {
+		return nil, err
+	}
+	md.UserData = string(ud)
+	return md, nil
+}
+
+func fetchEC2(c *http.Client, base string) (*metadata, error) {
+	// IMDSv2 session token; IMDSv1 services simply reject the PUT.
+	hdr := http.Header{}
+	if tok, err := metadataGet(c, "PUT", base+"/latest/api/token", http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"300"},
+	}); err == nil {
+		hdr.Set("X-Aws-Ec2-Metadata-Token", string(tok))
+	}
+	get := func(path string) (string, error) {
+		b, err := metadataGet(c, "GET", base+"/latest/"+path, hdr)
+		return strings.TrimSpace(string(b)), err
+	}
+
+	md := &metadata{}
+	var err error
+	if md.InstanceID, err = get("meta-data/instance-id"); err != nil {
+		return nil, fmt.Errorf("instance-id: %w", err)
+	}
+	if md.Hostname, err = get("meta-data/hostname"); err != nil && !errors.Is(err, errMetadataNotFound) {
+		return nil, fmt.Errorf("hostname: %w", err)
+	}
+	keys, err := get("meta-data/public-keys/")
+	if err != nil && !errors.Is(err, errMetadataNotFound) {
+		return nil, fmt.Errorf("public-keys: %w", err)
+	}
+	sc := bufio.NewScanner(strings.NewReader(keys))
+	for sc.Scan() {
+		// Listing lines look like "0=my-key".
+		idx, _, _ := strings.Cut(sc.Text(), "=")
+		if idx == "" {
+			continue
+		}
+		k, err := get("meta-data/public-keys/" + idx + "/openssh-key")
+		if err != nil {
+			return nil, fmt.Errorf("public-keys/%s: %w", idx, err)
+		}
+		if k != "" {
+			md.PublicKeys = append(md.PublicKeys, k)
+		}
+	}
+	ud, err := metadataGet(c, "GET", base+"/latest/user-data", hdr)
+	if err != nil && !errors.Is(err, errMetadataNotFound) {
+		return nil, fmt.Errorf("user-data: %w", err)
+	}
+	md.UserData = string(ud)
+	return md, nil
+}
+
+// metadataGet performs a request, retrying transport errors and 5xx
+// responses with a linear backoff.
+func metadataGet(c *http.Client, method, url string, hdr http.Header) ([]byte, error) {
+	var lastErr error
+	for attempt := 1; attempt <= metadataAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.StatusCode == http.StatusOK:
+			return b, nil
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, errMetadataNotFound
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("%s %s: %s", method, url, resp.Status)
+		default:
+			return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+		}
+	}
+	return nil, lastErr
+}
+
+func readMetadataCache(path string) (*metadata, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	md := &metadata{}
+	if err := json.Unmarshal(b, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func writeMetadataCache(path string, md *metadata) error {
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
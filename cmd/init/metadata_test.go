@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// metadataServer serves paths from files; anything else is a 404.
+func metadataServer(t *testing.T, files map[string]string, check func(*http.Request) bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if check != nil && !check(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/" {
+			return
+		}
+		v, ok := files[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(v))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchOpenStack(t *testing.T) {
+	srv := metadataServer(t, map[string]string{
+		"GET /openstack/latest/meta_data.json": `{"uuid": "i-1", "hostname": "node1", "public_keys": {"k": "ssh-ed25519 AAAA k\n"}}`,
+		"GET /openstack/latest/user_data":      "hostname=node2\n",
+	}, nil)
+	md, err := fetchMetadata(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &metadata{InstanceID: "i-1", Hostname: "node1", PublicKeys: []string{"ssh-ed25519 AAAA k"}, UserData: "hostname=node2\n"}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("fetchMetadata = %+v, want %+v", md, want)
+	}
+}
+
+func TestFetchEC2(t *testing.T) {
+	files := map[string]string{
+		"PUT /latest/api/token":                           "tok",
+		"GET /latest/meta-data/instance-id":               "i-2\n",
+		"GET /latest/meta-data/hostname":                  "ip-10-0-0-1",
+		"GET /latest/meta-data/public-keys/":              "0=a\n1=b",
+		"GET /latest/meta-data/public-keys/0/openssh-key": "ssh-ed25519 AAAA a",
+		"GET /latest/meta-data/public-keys/1/openssh-key": "ssh-ed25519 BBBB b\n",
+		"GET /latest/user-data":                           "ssh_port=2222\n",
+	}
+	// IMDSv2: every GET below /latest carries the session token.
+	srv := metadataServer(t, files, func(r *http.Request) bool {
+		return r.Method != "GET" || !strings.HasPrefix(r.URL.Path, "/latest/") || r.Header.Get("X-Aws-Ec2-Metadata-Token") == "tok"
+	})
+	md, err := fetchMetadata(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &metadata{
+		InstanceID: "i-2",
+		Hostname:   "ip-10-0-0-1",
+		PublicKeys: []string{"ssh-ed25519 AAAA a", "ssh-ed25519 BBBB b"},
+		UserData:   "ssh_port=2222\n",
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("fetchMetadata = %+v, want %+v", md, want)
+	}
+}
+
+func TestFetchEC2v1(t *testing.T) {
+	// IMDSv1 rejects the token PUT; hostname, keys and user-data are
+	// optional.
+	srv := metadataServer(t, map[string]string{
+		"GET /latest/meta-data/instance-id": "i-3",
+	}, func(r *http.Request) bool {
+		return r.Method != "PUT" && r.Header.Get("X-Aws-Ec2-Metadata-Token") == ""
+	})
+	md, err := fetchMetadata(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&metadata{InstanceID: "i-3"}); !reflect.DeepEqual(md, want) {
+		t.Errorf("fetchMetadata = %+v, want %+v", md, want)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	b, err := metadataGet(srv.Client(), "GET", srv.URL+"/x", nil)
+	if err != nil || string(b) != "ok" || calls.Load() != 2 {
+		t.Fatalf("metadataGet = %q, %v after %d calls", b, err, calls.Load())
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	c := srv.Client()
+	c.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := fetchMetadata(c, srv.URL); err == nil || !strings.Contains(err.Error(), "no metadata service") {
+		t.Fatalf("fetchMetadata = %v", err)
+	}
+	// The probe is not retried.
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+}
+
+func TestCachedMetadata(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "goos", "metadata.json")
+	srv := metadataServer(t, map[string]string{
+		"GET /openstack/latest/meta_data.json": `{"uuid": "i-4", "hostname": "node4"}`,
+	}, nil)
+	md, ok := cachedMetadata(srv.Client(), srv.URL, cache)
+	if !ok || md.InstanceID != "i-4" {
+		t.Fatalf("cachedMetadata = %+v, %v", md, ok)
+	}
+
+	// The service goes away; the cached copy is used.
+	srv.Close()
+	c := &http.Client{Timeout: 50 * time.Millisecond}
+	md, ok = cachedMetadata(c, srv.URL, cache)
+	if !ok || md.InstanceID != "i-4" || md.Hostname != "node4" {
+		t.Fatalf("cachedMetadata from cache = %+v, %v", md, ok)
+	}
+	if _, ok := cachedMetadata(c, srv.URL, ""); ok {
+		t.Error("cachedMetadata without service or cache succeeded")
+	}
+	if _, ok := cachedMetadata(c, srv.URL, filepath.Join(t.TempDir(), "none.json")); ok {
+		t.Error("cachedMetadata with an empty cache succeeded")
+	}
+}
+
+func TestMetadataConfig(t *testing.T) {
+	md := &metadata{
+		InstanceID: "i-5",
+		Hostname:   "node5",
+		PublicKeys: []string{"ssh-ed25519 AAAA a"},
+		UserData: strings.Join([]string{
+			"hostname=override",
+			"update_window=02:00-04:00",
+			"network=dhcp",
+			"ssh_key.evil=ssh-ed25519 EEEE evil",
+			"ssh_command_acl.evil=*",
+			"ssh_password_auth=true",
+			"update_url=http://elsewhere/updates",
+			"update_allow_downgrade=true",
+			"secrets=v1:AAAA",
+			"root_password_hash=$6$x$y",
+			"metadata=http://elsewhere",
+			"join_token=stolen",
+		}, "\n"),
+	}
+	got := md.config()
+	want := map[string]string{
+		"instance_id":        "i-5",
+		"hostname":           "override",
+		"ssh_key.metadata.0": "ssh-ed25519 AAAA a",
+		"network":            "dhcp",
+	}
+	if !reflect.DeepEqual(map[string]string(got), want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+
+	md.UserData = "#!/bin/sh\necho not a goos config\n"
+	if got := md.config(); got.Get("hostname") != "node5" {
+		t.Errorf("config with script user-data = %v", got)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	urootmount "github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/loop"
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/layout"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// newRoot is where the next root is assembled before switch_root.
+	newRoot = "/newroot"
+	// rootLower and rootRW hold the read-only root and the tmpfs upper
+	// layer when an overlay is used. They live under /run, which moves
+	// into the new root and stays visible there.
+	rootLower = "/run/goos/root/lower"
+	rootRW    = "/run/goos/root/rw"
+	// autoRoot asks for the GOOS-ROOT partition on the boot disk. It is
+	// optional: without one, boot stays in the initramfs.
+	autoRoot = "auto"
+)
+
+var errNoPartition = errors.New("partition not found")
+
+// rootSpec is a parsed goos.root= (or plain root=) setting.
+type rootSpec struct {
+	fstype  string // ext4, squashfs or erofs
+	source  string // device spec for ext4, path on the ESP for images
+	overlay bool   // put a tmpfs overlay on top
+	init    string // next-stage init inside the new root
+}
+
+// parseRoot reads the root to switch into from the kernel cmdline:
+//
+//	goos.root=PARTUUID=<uuid>        ext4 partition (also PARTLABEL=, /dev/...)
+//	goos.root=auto                   the GOOS-ROOT partition on the boot disk, if any
+//	goos.root=ext4:<device>          the same, spelled out
+//	goos.root=squashfs:<esp path>    squashfs image on the ESP
+//	goos.root=erofs:<esp path>       erofs image on the ESP
+//
+// root= is accepted as a synonym for an ext4 goos.root=. Images get a tmpfs
+// overlay by default since they are read-only; goos.root.overlay=0|1
+// overrides that. goos.init= names the init to exec, /init by default.
+func parseRoot() (rootSpec, bool) {
+	v, ok := cmdline.Value("goos.root")
+	if !ok || v == "" {
+		if v, ok = cmdline.Value("root"); !ok || v == "" {
+			return rootSpec{}, false
+		}
+	}
+	spec := rootSpec{fstype: "ext4", source: v, init: "/init"}
+	if typ, src, ok := strings.Cut(v, ":"); ok {
+		switch typ {
+		case "ext4", "squashfs", "erofs":
+			spec.fstype, spec.source = typ, src
+		}
+	}
+	spec.overlay = spec.fstype != "ext4"
+	if o, ok := cmdline.Value("goos.root.overlay"); ok {
+		spec.overlay = o == "1"
+	}
+	if i, ok := cmdline.Value("goos.init"); ok && i != "" {
+		spec.init = i
+	}
+	return spec, true
+}
+
+// switchRoot moves into the root named on the kernel cmdline. The kernel
+// ignores root= when it has an initramfs, so goos-init mounts it itself,
+// moves /dev, /proc, /sys and /run across, frees the initramfs and execs
+// the next-stage init; with the default /init that starts goos-init again
+// in the new root. It only returns when there is nothing to switch to or
+// the switch failed; boot then continues from the initramfs.
+func switchRoot() {
+	spec, ok := parseRoot()
+	if !ok || !inInitramfs() {
+		return
+	}
+	undo, err := mountRoot(spec)
+	if errors.Is(err, errNoPartition) && spec.source == autoRoot {
+		log("goos: no root partition; staying in initramfs")
+		undo()
+		return
+	}
+	if err != nil {
+		log("goos: root " + spec.fstype + ":" + spec.source + ": " + err.Error())
+		undo()
+		return
+	}
+	if _, err := os.Stat(filepath.Join(newRoot, spec.init)); err != nil {
+		log("goos: new root has no " + spec.init + "; staying in initramfs")
+		undo()
+		return
+	}
+	log("goos: switching root to " + spec.fstype + ":" + spec.source)
+	if err := urootmount.SwitchRoot(newRoot, spec.init); err != nil {
+		// The old root may already be gone; there is nothing safe to
+		// fall back to.
+		log("goos: " + err.Error())
+	}
+}
+
+// mountRoot assembles the new root at newRoot. The returned func undoes
+// whatever was mounted, also on error.
+func mountRoot(spec rootSpec) (func(), error) {
+	var undos []func()
+	undo := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+	target := newRoot
+	var flags uintptr
+	if spec.overlay {
+		target, flags = rootLower, syscall.MS_RDONLY
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return undo, err
+	}
+	switch spec.fstype {
+	case "ext4":
+		loadModules(ext4Modules...)
+		timeout := 10 * time.Second
+		if spec.source == autoRoot {
+			timeout = 2 * time.Second
+		}
+		dev, err := waitRoot(spec.source, timeout)
+		if err != nil {
+			return undo, err
+		}
+		if err := syscall.Mount(dev, target, "ext4", flags, ""); err != nil {
+			return undo, err
+		}
+	default:
+		loadModules(
+			"drivers/block/loop.ko",
+			"fs/squashfs/squashfs.ko",
+			"fs/erofs/erofs.ko",
+		)
+		if !espMounted() && !mountESP() {
+			return undo, errors.New("no ESP to load the image from")
+		}
+		l, err := loop.New(filepath.Join(config.ESPMount, spec.source), spec.fstype, "")
+		// The loop device keeps the image open; goos-init mounts the ESP
+		// again in the new root.
+		_ = syscall.Unmount(config.ESPMount, syscall.MNT_DETACH)
+		if err != nil {
+			return undo, err
+		}
+		if _, err := l.Mount(target, syscall.MS_RDONLY); err != nil {
+			_ = l.Free()
+			return undo, err
+		}
+		undos = append(undos, func() { _ = l.Free() })
+	}
+	undos = append(undos, func() { _ = syscall.Unmount(target, 0) })
+	if !spec.overlay {
+		return undo, nil
+	}
+
+	loadModules("fs/overlayfs/overlay.ko")
+	if err := os.MkdirAll(rootRW, 0o755); err != nil {
+		return undo, err
+	}
+	if err := syscall.Mount("tmpfs", rootRW, "tmpfs", 0, "mode=0755"); err != nil {
+		return undo, err
+	}
+	undos = append(undos, func() { _ = syscall.Unmount(rootRW, 0) })
+	upper, work := filepath.Join(rootRW, "upper"), filepath.Join(rootRW, "work")
+	for _, d := range []string{upper, work, newRoot} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return undo, err
+		}
+	}
+	opts := "lowerdir=" + rootLower + ",upperdir=" + upper + ",workdir=" + work
+	if err := syscall.Mount("overlay", newRoot, "overlay", 0, opts); err != nil {
+		return undo, err
+	}
+	undos = append(undos, func() { _ = syscall.Unmount(newRoot, 0) })
+	return undo, nil
+}
+
+// inInitramfs reports whether / is still the initramfs rather than a
+// switched-to root.
+func inInitramfs() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/", &st); err != nil {
+		return false
+	}
+	return st.Type == unix.RAMFS_MAGIC || st.Type == unix.TMPFS_MAGIC
+}
+
+// waitRoot resolves a root device spec, giving slow disks time to appear.
+func waitRoot(spec string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		dev, err := resolveRoot(spec)
+		if err == nil || time.Now().After(deadline) {
+			return dev, err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// resolveRoot maps auto, PARTUUID=, PARTLABEL= or a /dev path to a device
+// node.
+func resolveRoot(spec string) (string, error) {
+	var match func(*gpt.Partition) bool
+	if spec == autoRoot {
+		return autoRootDevice()
+	} else if v, ok := strings.CutPrefix(spec, "PARTUUID="); ok {
+		match = func(p *gpt.Partition) bool { return strings.EqualFold(p.GUID, v) }
+	} else if v, ok := strings.CutPrefix(spec, "PARTLABEL="); ok {
+		match = func(p *gpt.Partition) bool { return p.Name == v }
+	} else if strings.HasPrefix(spec, "/dev/") {
+		if _, err := os.Stat(spec); err != nil {
+			return "", err
+		}
+		return spec, nil
+	} else {
+		return "", errors.New("unsupported root= form")
+	}
+	p, ok := findPartition(match)
+	if !ok {
+		return "", errNoPartition
+	}
+	return p.dev, nil
+}
+
+// autoRootDevice finds the GOOS-ROOT partition on the boot disk. The ESP
+// is not mounted yet this early, so it is mounted just to find the disk
+// and let go again; goos-init mounts it again in the new root.
+func autoRootDevice() (string, error) {
+	if !espMounted() {
+		if !mountESP() {
+			return "", errNoPartition
+		}
+		defer syscall.Unmount(config.ESPMount, syscall.MNT_DETACH)
+	}
+	disk, ok := bootDisk()
+	if !ok {
+		return "", errNoPartition
+	}
+	p, ok := findDiskPartition(disk, func(p *gpt.Partition) bool {
+		return p.Name == layout.RootName && strings.EqualFold(string(p.Type), layout.RootType)
+	})
+	if !ok {
+		return "", errNoPartition
+	}
+	return p.dev, nil
+}
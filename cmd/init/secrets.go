@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/secrets"
+)
+
+// unsealSecrets decrypts the sealed block into cfg and exposes each secret
+// as a 0600 file under /run/goos/secrets. Plaintext only ever lives in
+// memory and on that tmpfs.
+func unsealSecrets(cfg config.Config) {
+	migrateSecrets(cfg)
+	sealed := cfg.Get(secrets.ConfigKey)
+	if sealed == "" {
+		return
+	}
+	delete(cfg, secrets.ConfigKey)
+	key, src, err := secretKey(false)
+	if err != nil {
+		log("goos: secrets: " + err.Error())
+		return
+	}
+	s, err := secrets.Open(key, sealed)
+	if err != nil {
+		log("goos: secrets: " + err.Error())
+		return
+	}
+	if err := os.MkdirAll(secrets.RunDir, 0o700); err != nil {
+		log("goos: secrets: " + err.Error())
+		return
+	}
+	for k, v := range s {
+		cfg[k] = v
+		if err := os.WriteFile(filepath.Join(secrets.RunDir, k), []byte(v), 0o600); err != nil {
+			log("goos: secrets: " + err.Error())
+		}
+	}
+	log("goos: unsealed " + strconv.Itoa(len(s)) + " secrets (key from " + src + ")")
+}
+
+// migrateSecrets seals plaintext secrets left by older installers and
+// drops them from the ESP copy of the config.
+func migrateSecrets(cfg config.Config) {
+	plain := config.Config{}
+	for _, k := range secrets.Keys {
+		if v := cfg.Get(k); v != "" {
+			plain[k] = v
+		}
+	}
+	if len(plain) == 0 || !espMounted() {
+		return
+	}
+	key, _, err := secretKey(true)
+	if err != nil {
+		log("goos: secrets: " + err.Error())
+		return
+	}
+	all := config.Config{}
+	if sealed := cfg.Get(secrets.ConfigKey); sealed != "" {
+		if all, err = secrets.Open(key, sealed); err != nil {
+			log("goos: secrets: " + err.Error())
+			return
+		}
+	}
+	all.Merge(plain)
+	sealed, err := secrets.Seal(key, all)
+	if err != nil {
+		log("goos: secrets: " + err.Error())
+		return
+	}
+	path := filepath.Join(config.ESPMount, config.Path)
+	if err := config.Update(path, config.Config{secrets.ConfigKey: sealed}, secrets.Keys...); err != nil {
+		log("goos: secrets: migrate: " + err.Error())
+		return
+	}
+	for k := range plain {
+		delete(cfg, k)
+	}
+	cfg[secrets.ConfigKey] = sealed
+	log("goos: sealed plaintext secrets in the ESP config")
+}
+
+// secretKey derives the sealing key from fw_cfg, goos.secret= or the
+// per-node key on the ESP, creating the latter if asked to.
+func secretKey(create bool) ([]byte, string, error) {
+	if m, src, ok := secrets.ExternalKey(); ok {
+		k, err := secrets.DeriveKey(m)
+		return k, src, err
+	}
+	path := filepath.Join(config.ESPMount, secrets.NodeKeyPath)
+	m, err := os.ReadFile(path)
+	if err != nil {
+		if !create {
+			return nil, "", fmt.Errorf("no key material: set fw_cfg opt/goos/secret or goos.secret=, or restore %s", secrets.NodeKeyPath)
+		}
+		if m, err = secrets.NewNodeKey(); err != nil {
+			return nil, "", err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, "", err
+		}
+		if err := os.WriteFile(path, m, 0o600); err != nil {
+			return nil, "", err
+		}
+	}
+	k, err := secrets.DeriveKey(m)
+	return k, "node key", err
+}
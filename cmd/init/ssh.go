@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/services"
+)
+
+const (
+	// bakedAuthorizedKeys is the file the Makefile bakes into the initramfs.
+	bakedAuthorizedKeys = "/authorized_keys"
+	// authorizedKeysPath is the merged file handed to goos-sshd.
+	authorizedKeysPath = "/run/goos/authorized_keys"
+	// userCAKeysPath is the merged file of trusted user certificate CAs.
+	userCAKeysPath = "/run/goos/trusted_user_ca_keys"
+	// revokedKeysFile is the default revocation list, relative to the ESP.
+	revokedKeysFile = "/goos/ssh/revoked_keys"
+	// sshdConfigPath is the goos-sshd config written at boot.
+	sshdConfigPath = "/run/goos/sshd.conf"
+)
+
+// sshSettings resolves sshd settings from the config, with goos.ssh*
+// cmdline options taking precedence. Without any config sshd runs, as on a
+// live boot.
+func sshSettings(cfg config.Config) (enabled bool, listen []string, port string) {
+	enabled = cfg.Bool("ssh_enabled", true)
+	if v, ok := cmdline.Value("goos.ssh"); ok {
+		enabled = v != "0"
+	}
+	listen = cfg.List("ssh_listen")
+	if v, ok := cmdline.Value("goos.ssh.listen"); ok {
+		listen = config.SplitList(v)
+	}
+	if len(listen) == 0 {
+		listen = []string{"0.0.0.0"}
+	}
+	port = cfg.Get("ssh_port")
+	if v, ok := cmdline.Value("goos.ssh.port"); ok {
+		port = v
+	}
+	if port == "" {
+		port = "2222"
+	}
+	return enabled, listen, port
+}
+
+// startSSHD writes the goos-sshd config and starts it, unless disabled.
+func startSSHD(cfg config.Config) {
+	enabled, listen, port := sshSettings(cfg)
+	if !enabled {
+		log("goos: sshd disabled")
+		_ = services.Write(services.Status{Name: "sshd", State: services.Disabled})
+		return
+	}
+	if _, err := exec.LookPath("goos-sshd"); err != nil {
+		return
+	}
+	hostKeys := cfg.List("ssh_host_keys")
+	if len(hostKeys) == 0 {
+		hostKeys = ensureHostKeys()
+	}
+	sc := config.Config{
+		"listen":          strings.Join(listen, ","),
+		"port":            port,
+		"host_keys":       strings.Join(hostKeys, ","),
+		"authorized_keys": ensureAuthorizedKeys(cfg),
+	}
+	if v := ensureUserCAKeys(cfg); v != "" {
+		sc["trusted_user_ca_keys"] = v
+	}
+	if v := cfg.List("ssh_authorized_principals"); len(v) > 0 {
+		sc["authorized_principals"] = strings.Join(v, ",")
+	}
+	if v := revokedKeysPath(cfg); v != "" {
+		sc["revoked_keys"] = v
+	}
+	for _, k := range []string{"max_auth_failures", "ban_time", "max_startups", "max_startups_per_ip", "max_sessions", "max_sessions_per_ip"} {
+		if v := cfg.Get("ssh_" + k); v != "" {
+			sc[k] = v
+		}
+	}
+	for _, k := range cfg.Keys() {
+		if name, ok := strings.CutPrefix(k, "ssh_command_acl."); ok {
+			sc["acl."+name] = cfg[k]
+		}
+	}
+	if v := cfg.Get("ssh_file_root"); v != "" {
+		sc["file_root"] = v
+	}
+	if v := cfg.List("ssh_readonly_paths"); len(v) > 0 {
+		sc["readonly_paths"] = strings.Join(v, ",")
+	}
+	if cfg.Bool("ssh_password_auth", false) {
+		sc["password_hash"] = rootPasswordHash(cfg)
+	}
+	if err := writeConfig(sshdConfigPath, sc); err != nil {
+		log("goos: sshd config: " + err.Error())
+		return
+	}
+	log(fmt.Sprintf("goos: starting sshd on %s port %s", strings.Join(listen, ","), port))
+	cmd := exec.Command("goos-sshd", "-config", sshdConfigPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	startService("sshd", cmd)
+}
+
+// ensureAuthorizedKeys merges every configured key source into one file
+// for goos-sshd: the keys baked into the initramfs, ssh_key entries from
+// the installer, metadata and user-data, and any files listed in
+// ssh_authorized_keys. Duplicates are dropped.
+func ensureAuthorizedKeys(cfg config.Config) string {
+	files := append([]string{bakedAuthorizedKeys}, cfg.List("ssh_authorized_keys")...)
+	n := mergeKeys(authorizedKeysPath, files, cfg.Prefixed("ssh_key"))
+	log(fmt.Sprintf("goos: %d authorized ssh keys", n))
+	return authorizedKeysPath
+}
+
+// ensureUserCAKeys merges the ssh_user_ca entries and the files listed in
+// ssh_trusted_user_ca_keys. It returns "" when no CA is configured.
+func ensureUserCAKeys(cfg config.Config) string {
+	files, keys := cfg.List("ssh_trusted_user_ca_keys"), cfg.Prefixed("ssh_user_ca")
+	if len(files) == 0 && len(keys) == 0 {
+		return ""
+	}
+	n := mergeKeys(userCAKeysPath, files, keys)
+	log(fmt.Sprintf("goos: %d trusted ssh user CAs", n))
+	return userCAKeysPath
+}
+
+// revokedKeysPath returns ssh_revoked_keys, or the list kept on the ESP if
+// there is one. goos-sshd rereads it on every login.
+func revokedKeysPath(cfg config.Config) string {
+	if v := cfg.Get("ssh_revoked_keys"); v != "" {
+		return v
+	}
+	path := filepath.Join(config.ESPMount, revokedKeysFile)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return ""
+}
+
+// mergeKeys writes the key lines from files and keys to path, dropping
+// duplicates and comments, and returns how many it wrote.
+func mergeKeys(path string, files, keys []string) int {
+	seen := map[string]bool{}
+	var b strings.Builder
+	add := func(line string) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+			return
+		}
+		seen[line] = true
+		b.WriteString(line + "\n")
+	}
+	for _, f := range files {
+		r, err := os.Open(f)
+		if err != nil {
+			if f != bakedAuthorizedKeys {
+				log("goos: ssh keys: " + err.Error())
+			}
+			continue
+		}
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			add(sc.Text())
+		}
+		r.Close()
+	}
+	for _, k := range keys {
+		add(k)
+	}
+	_ = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		log("goos: write " + path + ": " + err.Error())
+	}
+	return len(seen)
+}
+
+// writeConfig writes cfg as sorted key=value lines with 0600 permissions.
+func writeConfig(path string, cfg config.Config) error {
+	var b strings.Builder
+	for _, k := range cfg.Keys() {
+		fmt.Fprintf(&b, "%s=%s\n", k, cfg[k])
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
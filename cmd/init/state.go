@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/vpereira/goos/internal/layout"
+	"golang.org/x/sys/unix"
+)
+
+// ext4Modules are needed for the state and root partitions on kernels that
+// build ext4 as a module.
+var ext4Modules = []string{
+	"lib/crc16.ko",
+	"fs/mbcache.ko",
+	"fs/jbd2/jbd2.ko",
+	"fs/ext4/ext4.ko",
+}
+
+// diskPart is a GPT partition found on a local disk.
+type diskPart struct {
+	disk string // whole disk, e.g. sda
+	num  int    // GPT partition number
+	dev  string // partition device, e.g. /dev/sda2
+}
+
+// mountState checks, grows and mounts the state partition at
+// layout.StateMount. Only the GOOS-STATE partition on the boot disk is
+// used, so disks that merely carry a /var partition are left alone. A live
+// boot has none and keeps everything in memory.
+func mountState() {
+	loadModules(ext4Modules...)
+	p, ok := findBootPartition(layout.StateName)
+	if !ok {
+		log("goos: no state partition; " + layout.StateMount + " is not persistent")
+		return
+	}
+	if err := growState(p); err != nil {
+		log("goos: grow state partition: " + err.Error())
+	}
+	if _, ok := ext4Size(p.dev); !ok {
+		// Installers without mke2fs leave the partition blank. Anything
+		// else may be a damaged filesystem worth recovering by hand.
+		blank, err := isBlank(p.dev, layout.StateBlank)
+		if err != nil {
+			log("goos: read state partition: " + err.Error())
+			return
+		}
+		if !blank {
+			log("goos: state partition " + p.dev + " holds no ext4 filesystem and is not blank; not formatting")
+			return
+		}
+		log("goos: formatting state partition " + p.dev)
+		if err := run("mke2fs", "-q", "-t", "ext4", "-L", layout.StateName, p.dev); err != nil {
+			log("goos: format state partition: " + err.Error())
+			return
+		}
+	} else {
+		checkState(p.dev)
+	}
+	_ = os.MkdirAll(layout.StateMount, 0o755)
+	if err := syscall.Mount(p.dev, layout.StateMount, "ext4", syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		log("goos: mount state partition: " + err.Error())
+		return
+	}
+	log("goos: mounted state " + p.dev + " at " + layout.StateMount)
+	resizeState(p.dev)
+}
+
+// enableSwap turns on the GOOS-SWAP partition the installer laid out on the
+// boot disk, if any. Swap partitions on other disks are not GOOS's to use.
+func enableSwap() {
+	p, ok := findBootPartition(layout.SwapName)
+	if !ok {
+		return
+	}
+	dev, err := unix.BytePtrFromString(p.dev)
+	if err != nil {
+		return
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(dev)), 0, 0); errno != 0 {
+		log("goos: swapon " + p.dev + ": " + errno.Error())
+		return
+	}
+	log("goos: enabled swap on " + p.dev)
+}
+
+// findPartition returns the first GPT partition on any disk that match
+// accepts.
+func findPartition(match func(*gpt.Partition) bool) (diskPart, bool) {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return diskPart{}, false
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "sr") {
+			continue
+		}
+		if p, ok := findDiskPartition(name, match); ok {
+			return p, true
+		}
+	}
+	return diskPart{}, false
+}
+
+// findBootPartition returns the partition GOOS named name on the disk the
+// ESP was mounted from.
+func findBootPartition(name string) (diskPart, bool) {
+	disk, ok := bootDisk()
+	if !ok {
+		return diskPart{}, false
+	}
+	return findDiskPartition(disk, func(p *gpt.Partition) bool { return p.Name == name })
+}
+
+// findDiskPartition returns the first GPT partition on disk that match
+// accepts.
+func findDiskPartition(disk string, match func(*gpt.Partition) bool) (diskPart, bool) {
+	t, err := readGPT(disk)
+	if err != nil {
+		return diskPart{}, false
+	}
+	for i, p := range t.Partitions {
+		if !match(p) {
+			continue
+		}
+		dev := partitionDevice(disk, i+1)
+		if dev == "" {
+			continue
+		}
+		return diskPart{disk: disk, num: i + 1, dev: dev}, true
+	}
+	return diskPart{}, false
+}
+
+func readGPT(disk string) (*gpt.Table, error) {
+	d, err := diskfs.Open(filepath.Join("/dev", disk), diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Backend.Close()
+	pt, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := pt.(*gpt.Table)
+	if !ok {
+		return nil, errors.New("not a GPT disk")
+	}
+	return t, nil
+}
+
+// partitionDevice returns the /dev node of partition num on disk, as
+// named by the kernel.
+func partitionDevice(disk string, num int) string {
+	entries, err := os.ReadDir(filepath.Join("/sys/block", disk))
+	if err != nil {
+		return ""
+	}
+	want := strconv.Itoa(num)
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join("/sys/block", disk, e.Name(), "partition"))
+		if err == nil && strings.TrimSpace(string(b)) == want {
+			return filepath.Join("/dev", e.Name())
+		}
+	}
+	return ""
+}
+
+// growState extends the state partition to the end of its disk when it is
+// the last partition. This happens on first boot and again whenever the
+// virtual disk is enlarged.
+func growState(p diskPart) error {
+	d, err := diskfs.Open(filepath.Join("/dev", p.disk), diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		return err
+	}
+	defer d.Backend.Close()
+	pt, err := d.GetPartitionTable()
+	if err != nil {
+		return err
+	}
+	t, ok := pt.(*gpt.Table)
+	if !ok || p.num > len(t.Partitions) {
+		return errors.New("state partition vanished")
+	}
+	part := t.Partitions[p.num-1]
+	for _, o := range t.Partitions {
+		if o.Start > part.Start {
+			return nil
+		}
+	}
+	// Move the backup GPT to the end of a disk that has grown.
+	t.Resize(uint64(d.Size))
+	sector := uint64(t.LogicalSectorSize)
+	align := uint64(1<<20) / sector
+	end := (t.LastDataSector()+1)/align*align - 1
+	if end < part.End+align {
+		return nil
+	}
+	part.Expand(end - part.End)
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	if err := t.Write(w, d.Size); err != nil {
+		return err
+	}
+	// Other partitions may be mounted, so BLKRRPART would fail with EBUSY;
+	// resize just this one in the kernel's view instead.
+	f, err := d.Backend.Sys()
+	if err != nil {
+		return err
+	}
+	bp := unix.BlkpgPartition{
+		Start:  int64(part.Start * sector),
+		Length: int64((part.End - part.Start + 1) * sector),
+		Pno:    int32(p.num),
+	}
+	arg := unix.BlkpgIoctlArg{
+		Op:      unix.BLKPG_RESIZE_PARTITION,
+		Datalen: int32(unsafe.Sizeof(bp)),
+		Data:    (*byte)(unsafe.Pointer(&bp)),
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKPG, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		return errno
+	}
+	log("goos: grew state partition to " + strconv.FormatInt(bp.Length>>20, 10) + " MiB")
+	return nil
+}
+
+// checkState runs e2fsck in preen mode and falls back to answering yes to
+// everything when preening cannot fix the filesystem.
+func checkState(dev string) {
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		log("goos: e2fsck not found; skipping state check")
+		return
+	}
+	err := run("e2fsck", "-p", dev)
+	var exit *exec.ExitError
+	if err == nil || errors.As(err, &exit) && exit.ExitCode() < 4 {
+		return
+	}
+	log("goos: state partition needs repair: " + err.Error())
+	if err := run("e2fsck", "-f", "-y", dev); err != nil {
+		log("goos: repair state partition: " + err.Error())
+	}
+}
+
+// resizeState grows the mounted filesystem when it is smaller than its
+// partition.
+func resizeState(dev string) {
+	fs, ok := ext4Size(dev)
+	if !ok {
+		return
+	}
+	b, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(dev), "size"))
+	if err != nil {
+		return
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || sectors*512 < fs+1<<20 {
+		return
+	}
+	if err := run("resize2fs", dev); err != nil {
+		log("goos: resize state filesystem: " + err.Error())
+	}
+}
+
+// ext4Size reads the filesystem size in bytes from the ext4 superblock.
+// It reports false when dev holds no ext4 filesystem.
+func ext4Size(dev string) (uint64, bool) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, 1024); err != nil {
+		return 0, false
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[0x38:]) != 0xEF53 {
+		return 0, false
+	}
+	blocks := uint64(le.Uint32(sb[0x04:]))
+	// INCOMPAT_64BIT carries the high half of the block count.
+	if le.Uint32(sb[0x60:])&0x80 != 0 {
+		blocks |= uint64(le.Uint32(sb[0x150:])) << 32
+	}
+	return blocks << (10 + le.Uint32(sb[0x18:])), true
+}
+
+// isBlank reports whether the first n bytes of dev are all zeros.
+func isBlank(dev string, n int) (bool, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return false, err
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
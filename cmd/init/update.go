@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/services"
+)
+
+// updateConfigPath is the goos-update config written at boot.
+const updateConfigPath = "/run/goos/update.conf"
+
+// updateURL is update_url, or the master's update endpoint for nodes that
+// joined one.
+func updateURL(cfg config.Config) string {
+	if v := cfg.Get("update_url"); v != "" {
+		return v
+	}
+	if m := cfg.Get("master_url"); m != "" {
+		return strings.TrimSuffix(m, "/") + "/updates/goos"
+	}
+	return ""
+}
+
+// startUpdateAgent starts goos-update on nodes booted from a boot slot
+// that have somewhere to fetch bundles from. Bundles only replace the
+// kernel and initramfs, so nodes that switched into another root are not
+// updated.
+func startUpdateAgent(cfg config.Config) {
+	url := updateURL(cfg)
+	if _, ok := cmdline.Value("goos.slot"); !ok || url == "" || !cfg.Bool("update_enabled", true) {
+		_ = services.Write(services.Status{Name: "update", State: services.Disabled})
+		return
+	}
+	if !inInitramfs() {
+		log("goos: updates do not replace the root filesystem; not starting the update agent")
+		_ = services.Write(services.Status{Name: "update", State: services.Disabled, Detail: "root filesystem is not updated"})
+		return
+	}
+	if _, err := exec.LookPath("goos-update"); err != nil {
+		return
+	}
+	uc := config.Config{"url": url}
+	for _, k := range []string{"interval", "window", "allow_downgrade"} {
+		if v := cfg.Get("update_" + k); v != "" {
+			uc[k] = v
+		}
+	}
+	if err := writeConfig(updateConfigPath, uc); err != nil {
+		log("goos: update config: " + err.Error())
+		return
+	}
+	log("goos: starting update agent for " + url)
+	cmd := exec.Command("goos-update", "-config", updateConfigPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	startService("update", cmd)
+}
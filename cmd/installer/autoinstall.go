@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/blkid"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/layout"
+	"github.com/vpereira/goos/internal/passwd"
+)
+
+// Unattended installs are started with goos.autoinstall=<source>:
+//
+//	iso:<path>                 file on the installer ISO
+//	label:<LABEL>[:<path>]     file on a vfat volume with that label
+//	fw_cfg                     QEMU -fw_cfg name=opt/goos/autoinstall,file=...
+//	http://... or https://...  fetched after DHCP
+//
+// The answer file uses the installer config format. The installer prints
+// a GOOS-AUTOINSTALL: PASS or FAIL line and exits non-zero on failure.
+const (
+	autoinstallFile  = "/goos-autoinstall.conf"
+	autoinstallFwCfg = "/sys/firmware/qemu_fw_cfg/by_name/opt/goos/autoinstall/raw"
+)
+
+// Actions after a successful unattended install.
+const (
+	finishReboot   = "reboot"
+	finishPowerOff = "poweroff"
+	finishExit     = "exit"
+)
+
+// answerKeys are the keys an answer file may set.
+var answerKeys = map[string]bool{
+	"disk": true, "network": true, "static_ipv4": true, "static_gw": true, "static_dns": true,
+	"disk_by_id": true, "disk_by_path": true, "disk_serial": true, "disk_wwn": true,
+	"disk_model": true, "disk_min_size": true, "disk_max_size": true, "disk_rotational": true,
+	"disk_transport": true, "disk_pick": true,
+	"ssh_enabled": true, "ssh_key": true, "root_password": true, "root_password_hash": true,
+	"role": true, "master_url": true, "join_token": true, "root_fs": true, "boot": true,
+	"finish": true, "erase_existing": true, "wipe": true, "layout": true,
+}
+
+// autoInstall runs an unattended install and returns the exit code.
+func autoInstall(src string) int {
+	printHeader()
+	fmt.Printf("Unattended install from `%s`\n", src)
+	fmt.Println()
+	// Mount the installer media first so the disk holding it is known.
+	_ = mountISO()
+	cfg, finish, err := loadAnswers(src)
+	if err == nil {
+		fmt.Printf("Install target: `%s`\n", cfg.Disk)
+		fmt.Printf("Wipe: `%s`\n", wipeLabel(cfg.Wipe))
+		fmt.Printf("Boot: `%s`\n", bootLabel(cfg.Boot))
+		fmt.Printf("Root filesystem: `%s`\n", rootLabel(cfg.RootFS))
+		if cfg.Layout != nil {
+			fmt.Printf("Layout: `%s`\n", cfg.Layout)
+		}
+		fmt.Println()
+		printContents(readDisk(cfg.Disk, readMounts()))
+		fmt.Println()
+		err = installDisk(cfg)
+	}
+	if err != nil {
+		autoinstallResult("FAIL: " + err.Error())
+		return 1
+	}
+	autoinstallResult("PASS")
+	syscall.Sync()
+	switch finish {
+	case finishReboot:
+		_ = syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+	case finishPowerOff:
+		_ = syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	}
+	return 0
+}
+
+// autoinstallResult prints the result line on the console and the kernel
+// log, where automation watching the serial port can find it.
+func autoinstallResult(msg string) {
+	line := "GOOS-AUTOINSTALL: " + msg
+	fmt.Println()
+	fmt.Println(line)
+	_ = os.WriteFile("/dev/kmsg", []byte(line+"\n"), 0o644)
+}
+
+// loadAnswers reads the answer file from src and turns it into an
+// installer config and finish action.
+func loadAnswers(src string) (installerConfig, string, error) {
+	raw, err := readAnswers(src)
+	if err != nil {
+		return installerConfig{}, "", fmt.Errorf("answer file %s: %w", src, err)
+	}
+	a, err := config.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return installerConfig{}, "", fmt.Errorf("answer file %s: %w", src, err)
+	}
+	return parseAnswers(a)
+}
+
+func parseAnswers(a config.Config) (installerConfig, string, error) {
+	for k := range a {
+		if !answerKeys[k] {
+			return installerConfig{}, "", fmt.Errorf("answer file: unknown key %q", k)
+		}
+	}
+	rule, err := parseDiskRule(a)
+	if err != nil {
+		return installerConfig{}, "", fmt.Errorf("answer file: %w", err)
+	}
+	disk, err := rule.selectDisk(listDisks())
+	if err != nil {
+		return installerConfig{}, "", fmt.Errorf("answer file: %w", err)
+	}
+	if err := checkTarget(disk); err != nil {
+		return installerConfig{}, "", fmt.Errorf("refusing to install: %w", err)
+	}
+	if hasData(disk) && !a.Bool("erase_existing", false) {
+		printContents(disk)
+		return installerConfig{}, "", fmt.Errorf("%s has data on it; set erase_existing=true to erase it", disk.name)
+	}
+	cfg := installerConfig{
+		Disk:         disk.name,
+		Network:      orDefault(a.Get("network"), "dhcp"),
+		StaticIPv4:   a.Get("static_ipv4"),
+		StaticGW:     a.Get("static_gw"),
+		StaticDNS:    a.Get("static_dns"),
+		SSHEnabled:   a.Bool("ssh_enabled", false),
+		SSHKey:       a.Get("ssh_key"),
+		RootPassHash: a.Get("root_password_hash"),
+		Role:         orDefault(a.Get("role"), "none"),
+		MasterURL:    a.Get("master_url"),
+		JoinToken:    a.Get("join_token"),
+		Boot:         orDefault(a.Get("boot"), defaultBootMode()),
+		Wipe:         orDefault(a.Get("wipe"), wipeSignatures),
+	}
+	switch cfg.Network {
+	case "dhcp":
+	case "static":
+		if cfg.StaticIPv4 == "" {
+			return cfg, "", fmt.Errorf("answer file: static network needs static_ipv4")
+		}
+	default:
+		return cfg, "", fmt.Errorf("answer file: network must be dhcp or static")
+	}
+	switch cfg.Role {
+	case "none":
+	case "worker", "master":
+		if cfg.MasterURL == "" {
+			return cfg, "", fmt.Errorf("answer file: role %s needs master_url", cfg.Role)
+		}
+	default:
+		return cfg, "", fmt.Errorf("answer file: role must be none, worker or master")
+	}
+	switch a.Get("root_fs") {
+	case "", "initramfs":
+	case "ext4":
+		cfg.RootFS = true
+	default:
+		return cfg, "", fmt.Errorf("answer file: root_fs must be initramfs or ext4")
+	}
+	if v := a.Get("layout"); v != "" {
+		spec, err := layout.ParseSpec(v)
+		if err != nil {
+			return cfg, "", fmt.Errorf("answer file: %w", err)
+		}
+		// A root partition implies root_fs=ext4 unless that says otherwise.
+		if spec.Has(layout.RoleRoot) && a.Get("root_fs") == "" {
+			cfg.RootFS = true
+		}
+		if spec.Has(layout.RoleRoot) != cfg.RootFS {
+			return cfg, "", fmt.Errorf("answer file: layout needs a root partition exactly when root_fs=ext4")
+		}
+		cfg.Layout = spec
+	}
+	switch cfg.Wipe {
+	case wipeSignatures, wipeDiscard, wipeZero:
+	default:
+		return cfg, "", fmt.Errorf("answer file: wipe must be signatures, discard or zero")
+	}
+	switch cfg.Boot {
+	case bootUEFI, bootBIOS, bootHybrid:
+	default:
+		return cfg, "", fmt.Errorf("answer file: boot must be uefi, bios or hybrid")
+	}
+	if p := a.Get("root_password"); p != "" {
+		if cfg.RootPassHash != "" {
+			return cfg, "", fmt.Errorf("answer file: set root_password or root_password_hash, not both")
+		}
+		h, err := passwd.Hash(p)
+		if err != nil {
+			return cfg, "", fmt.Errorf("hash password: %w", err)
+		}
+		cfg.RootPassHash = h
+	}
+	finish := orDefault(a.Get("finish"), finishPowerOff)
+	switch finish {
+	case finishReboot, finishPowerOff, finishExit:
+	default:
+		return cfg, "", fmt.Errorf("answer file: finish must be reboot, poweroff or exit")
+	}
+	return cfg, finish, nil
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// readAnswers fetches the answer file named by a goos.autoinstall= source.
+func readAnswers(src string) ([]byte, error) {
+	switch {
+	case src == "fw_cfg":
+		return os.ReadFile(autoinstallFwCfg)
+	case strings.HasPrefix(src, "iso:"):
+		if err := mountISO(); err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.Join("/mnt/iso", strings.TrimPrefix(src, "iso:")))
+	case strings.HasPrefix(src, "label:"):
+		label, path, _ := strings.Cut(strings.TrimPrefix(src, "label:"), ":")
+		return readFromLabel(label, orDefault(path, autoinstallFile))
+	case strings.HasPrefix(src, "http://"), strings.HasPrefix(src, "https://"):
+		return fetchAnswers(src)
+	}
+	return nil, fmt.Errorf("unknown source; want iso:, label:, fw_cfg or http(s)://")
+}
+
+// readFromLabel mounts the vfat volume labelled label and reads path from
+// it.
+func readFromLabel(label, path string) ([]byte, error) {
+	loadFATModules()
+	loadISOModules()
+	dev, ok := findVFATLabel(label)
+	for i := 0; !ok && i < 20; i++ {
+		// USB sticks may show up late.
+		time.Sleep(500 * time.Millisecond)
+		dev, ok = findVFATLabel(label)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no vfat volume labelled %s", label)
+	}
+	const target = "/mnt/autoinstall"
+	_ = os.MkdirAll(target, 0o755)
+	if err := syscall.Mount(dev, target, "vfat", syscall.MS_RDONLY, ""); err != nil {
+		return nil, fmt.Errorf("mount %s: %w", dev, err)
+	}
+	defer syscall.Unmount(target, 0)
+	return os.ReadFile(filepath.Join(target, path))
+}
+
+// findVFATLabel looks through disks and partitions for a FAT volume label.
+func findVFATLabel(label string) (string, bool) {
+	entries, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		dev := filepath.Join("/dev", e.Name())
+		sigs, err := blkid.ProbeFile(dev)
+		if err != nil {
+			continue
+		}
+		if c, ok := blkid.Content(sigs); ok && c.Type == "vfat" && strings.EqualFold(c.Label, label) {
+			return dev, true
+		}
+	}
+	return "", false
+}
+
+// fetchAnswers brings up DHCP and downloads the answer file.
+func fetchAnswers(url string) ([]byte, error) {
+	loadNetModules()
+	_ = runCmd("ip", "link", "set", "lo", "up")
+	if err := runCmd("dhclient", "-ipv4", "-ipv6=false", "-timeout", "15"); err != nil {
+		return nil, fmt.Errorf("dhcp: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func loadNetModules() {
+	kver := kernelRelease()
+	if kver == "" {
+		return
+	}
+	for _, rel := range []string{
+		"net/core/failover.ko",
+		"drivers/net/net_failover.ko",
+		"drivers/net/virtio_net.ko",
+		"drivers/net/ethernet/intel/e1000/e1000.ko",
+	} {
+		mod := filepath.Join("/lib/modules", kver, "kernel", rel)
+		if _, err := os.Stat(mod); err == nil {
+			_ = runCmd("insmod", mod)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+}
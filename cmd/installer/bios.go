@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/vpereira/goos/internal/slots"
+)
+
+// Boot modes. BIOS installs boot the ESP through syslinux: gptmbr.bin in
+// the MBR chains to the partition with the legacy BIOS bootable attribute,
+// whose boot sector extlinux writes. The same ESP still carries
+// systemd-boot, so a hybrid install boots both ways; its syslinux boots the
+// A/B slot files, following the slot goos-init last blessed.
+const (
+	bootUEFI   = "uefi"
+	bootBIOS   = "bios"
+	bootHybrid = "hybrid"
+)
+
+const (
+	// syslinuxDir holds gptmbr.bin in the initramfs.
+	syslinuxDir = "/lib/syslinux"
+	// biosDir holds the kernel and initramfs a BIOS install boots,
+	// relative to the ESP root. BIOS installs have no boot counting, so
+	// they do not use the A/B slots.
+	biosDir = "/goos/bios"
+	// legacyBootable is the GPT "legacy BIOS bootable" attribute bit.
+	legacyBootable = 1 << 2
+)
+
+// defaultBootMode matches the firmware the installer was started from.
+func defaultBootMode() string {
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		return bootUEFI
+	}
+	return bootBIOS
+}
+
+// writeBIOSFiles puts the kernel, initramfs and syslinux.cfg on the ESP.
+func writeBIOSFiles(esp filesystem.FileSystem, kernel, initrd []byte, options string) error {
+	if err := mkdirAll(esp, biosDir); err != nil {
+		return err
+	}
+	if err := writeFile(esp, biosDir+"/vmlinuz", kernel); err != nil {
+		return err
+	}
+	if err := writeFile(esp, biosDir+"/initramfs.cpio", initrd); err != nil {
+		return err
+	}
+	return writeSyslinuxConf(esp, biosDir+"/vmlinuz", biosDir+"/initramfs.cpio", options)
+}
+
+// writeSyslinuxConf writes a syslinux.cfg booting kernel and initrd, paths
+// on the ESP. There is no goos.slot option: BIOS boots are never on trial
+// and do not run the update agent.
+func writeSyslinuxConf(esp filesystem.FileSystem, kernel, initrd, options string) error {
+	if err := mkdirAll(esp, "/syslinux"); err != nil {
+		return err
+	}
+	conf := "DEFAULT goos\n" +
+		"PROMPT 0\n" +
+		"TIMEOUT 0\n" +
+		"LABEL goos\n" +
+		"  LINUX " + kernel + "\n" +
+		"  INITRD " + initrd + "\n" +
+		"  APPEND " + options + "\n"
+	return writeFile(esp, slots.SyslinuxConf, []byte(conf))
+}
+
+// installBIOS makes the disk boot on BIOS: extlinux writes its boot sector
+// and ldlinux into the ESP, and gptmbr.bin goes into the MBR.
+func installBIOS(disk, boot string) error {
+	mbr, err := os.ReadFile(filepath.Join(syslinuxDir, "gptmbr.bin"))
+	if err != nil {
+		return fmt.Errorf("BIOS install needs syslinux: %w", err)
+	}
+	if len(mbr) < 440 {
+		return fmt.Errorf("gptmbr.bin: too short")
+	}
+	loadFATModules()
+	dev := partDevice(disk, 1)
+	waitDevice(dev)
+	const target = "/mnt/esp"
+	_ = os.MkdirAll(target, 0o755)
+	if err := syscall.Mount(dev, target, "vfat", 0, ""); err != nil {
+		return fmt.Errorf("mount ESP: %w", err)
+	}
+	err = runCmd("extlinux", "--install", filepath.Join(target, "syslinux"))
+	syscall.Sync()
+	if uerr := syscall.Unmount(target, 0); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return fmt.Errorf("extlinux: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join("/dev", disk), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sector := make([]byte, 512)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	// Keep the partition table. BIOS installs mark the protective partition
+	// active for BIOSes that only boot a disk with one. UEFI requires it to
+	// stay inactive, and some firmware ignores the GPT otherwise, so hybrid
+	// installs leave it alone.
+	copy(sector, mbr[:440])
+	if boot == bootBIOS {
+		sector[446] = 0x80
+	}
+	if _, err := f.WriteAt(sector, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	fmt.Println("* Installed syslinux for BIOS boot")
+	return nil
+}
+
+func loadFATModules() {
+	kver := kernelRelease()
+	if kver == "" {
+		return
+	}
+	for _, rel := range []string{"fs/fat/fat.ko", "fs/fat/vfat.ko", "fs/nls/nls_cp437.ko", "fs/nls/nls_iso8859-1.ko"} {
+		mod := filepath.Join("/lib/modules", kver, "kernel", rel)
+		if _, err := os.Stat(mod); err == nil {
+			_ = runCmd("insmod", mod)
+		}
+	}
+}
+
+func bootLabel(mode string) string {
+	switch mode {
+	case bootBIOS:
+		return "BIOS"
+	case bootHybrid:
+		return "UEFI and BIOS"
+	}
+	return "UEFI"
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vpereira/goos/internal/blkid"
+)
+
+// diskInfo describes a whole disk from /sys/block.
+type diskInfo struct {
+	name  string
+	size  string
+	model string
+	// bytes is the size in bytes, 0 if unknown.
+	bytes      uint64
+	serial     string
+	wwn        string
+	transport  string // nvme, virtio, sata, scsi, usb, mmc or ""
+	rotational bool
+	// ids and paths are the names the disk has, or would have, under
+	// /dev/disk/by-id and /dev/disk/by-path.
+	ids   []string
+	paths []string
+
+	removable bool
+	readOnly  bool
+	// installMedia is set for the disk the installer ISO is mounted from.
+	installMedia bool
+	table        string // gpt, dos or ""
+	// content is the filesystem or volume on the whole disk, if any.
+	content blkid.Signature
+	parts   []partInfo
+	// mounts are the mountpoints of the disk itself.
+	mounts []string
+	// holders are the dm and md devices built on the disk.
+	holders []string
+}
+
+// partInfo describes a partition of a disk.
+type partInfo struct {
+	name   string
+	size   string
+	fstype string
+	label  string
+	mounts []string
+}
+
+func detectDisks() []diskInfo {
+	disks := listDisks()
+	if len(disks) == 0 {
+		disks = append(disks, diskInfo{name: "unknown", size: "0", model: "unknown"})
+	}
+	return disks
+}
+
+// listDisks returns the disks that could be install targets.
+func listDisks() []diskInfo {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+	links := diskLinks()
+	mounts := readMounts()
+	var disks []diskInfo
+	for _, e := range entries {
+		name := e.Name()
+		if skipDisk(name) {
+			continue
+		}
+		d := readDisk(name, mounts)
+		if d.readOnly || d.bytes == 0 {
+			// The installer ISO attached as a read-only disk, or an empty
+			// card reader.
+			continue
+		}
+		d.ids = appendUnique(d.ids, links[name].ids...)
+		d.paths = appendUnique(d.paths, links[name].paths...)
+		disks = append(disks, d)
+	}
+	return disks
+}
+
+// skipDisk leaves out block devices that are not disks: loop, RAM and
+// compressed RAM disks, optical and floppy drives, device-mapper, md and
+// network block devices, and the boot and RPMB areas of eMMC.
+func skipDisk(name string) bool {
+	for _, prefix := range []string{"loop", "ram", "zram", "sr", "fd", "dm-", "md", "nbd"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	if strings.HasPrefix(name, "mmcblk") && (strings.Contains(name, "boot") || strings.Contains(name, "rpmb")) {
+		return true
+	}
+	return false
+}
+
+func readDisk(name string, mounts map[string][]string) diskInfo {
+	d := diskInfo{
+		name:         name,
+		size:         readSize(name),
+		model:        readModel(name),
+		bytes:        readBytes(name),
+		serial:       readSerial(name),
+		wwn:          readWWN(name),
+		rotational:   sysfsValue(name, "queue/rotational") == "1",
+		removable:    sysfsValue(name, "removable") == "1",
+		readOnly:     sysfsValue(name, "ro") == "1",
+		mounts:       mounts[name],
+		installMedia: installMediaDisk(mounts) == name,
+		holders:      readHolders(filepath.Join("/sys/block", name)),
+	}
+	dev, _ := filepath.EvalSymlinks(filepath.Join("/sys/block", name))
+	d.transport = transport(name, dev)
+	d.ids, d.paths = diskNames(d, dev)
+	if d.readOnly || d.bytes == 0 {
+		return d
+	}
+	if sigs, err := blkid.ProbeFile(filepath.Join("/dev", name)); err == nil {
+		d.table = blkid.Table(sigs)
+		d.content, _ = blkid.Content(sigs)
+	}
+	d.parts = readParts(name, mounts)
+	for _, p := range d.parts {
+		d.holders = append(d.holders, readHolders(filepath.Join("/sys/block", name, p.name))...)
+	}
+	return d
+}
+
+// readParts lists the partitions the kernel knows on a disk.
+func readParts(disk string, mounts map[string][]string) []partInfo {
+	entries, err := os.ReadDir(filepath.Join("/sys/block", disk))
+	if err != nil {
+		return nil
+	}
+	var parts []partInfo
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join("/sys/block", disk, e.Name(), "partition")); err != nil {
+			continue
+		}
+		p := partInfo{name: e.Name(), size: "unknown", mounts: mounts[e.Name()]}
+		if sec, err := strconv.ParseUint(sysfsValue(disk, e.Name()+"/size"), 10, 64); err == nil {
+			p.size = formatSize(sec * 512)
+		}
+		if sigs, err := blkid.ProbeFile(filepath.Join("/dev", e.Name())); err == nil {
+			if c, ok := blkid.Content(sigs); ok {
+				p.fstype, p.label = c.Type, c.Label
+			}
+		}
+		parts = append(parts, p)
+	}
+	sort.Slice(parts, func(i, j int) bool { return partNumber(parts[i].name) < partNumber(parts[j].name) })
+	return parts
+}
+
+func partNumber(name string) int {
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	n, _ := strconv.Atoi(name[i:])
+	return n
+}
+
+func readHolders(dir string) []string {
+	entries, err := os.ReadDir(filepath.Join(dir, "holders"))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// readMounts maps block device names to where they are mounted.
+func readMounts() map[string][]string {
+	b, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	mounts := map[string][]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || !strings.HasPrefix(f[0], "/dev/") {
+			continue
+		}
+		dev := f[0]
+		if target, err := filepath.EvalSymlinks(dev); err == nil {
+			dev = target
+		}
+		name := filepath.Base(dev)
+		mounts[name] = append(mounts[name], f[1])
+	}
+	return mounts
+}
+
+// sysfsValue reads an attribute below /sys/block/<name>.
+func sysfsValue(name, attr string) string {
+	b, err := os.ReadFile(filepath.Join("/sys/block", name, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readBytes(name string) uint64 {
+	sec, err := strconv.ParseUint(sysfsValue(name, "size"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sec * 512
+}
+
+func readSize(name string) string {
+	b := readBytes(name)
+	if b == 0 {
+		return "unknown"
+	}
+	return formatSize(b)
+}
+
+func formatSize(bytes uint64) string {
+	gib := float64(bytes) / (1024 * 1024 * 1024)
+	if gib >= 1 {
+		return fmt.Sprintf("%.1fG", gib)
+	}
+	mb := float64(bytes) / (1024 * 1024)
+	return fmt.Sprintf("%.0fM", mb)
+}
+
+func readModel(name string) string {
+	if m := sysfsValue(name, "device/model"); m != "" {
+		return m
+	}
+	return "unknown"
+}
+
+// readSerial finds the serial number where each driver puts it: virtio-blk
+// on the disk, NVMe and MMC on the controller, SCSI and SATA in VPD page
+// 0x80.
+func readSerial(name string) string {
+	for _, attr := range []string{"serial", "device/serial"} {
+		if s := sysfsValue(name, attr); s != "" {
+			return s
+		}
+	}
+	b, err := os.ReadFile(filepath.Join("/sys/block", name, "device", "vpd_pg80"))
+	if err != nil || len(b) < 4 {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(string(b[4:]), "\x00"))
+}
+
+// readWWN returns the world wide name without its naa./eui. prefix, in
+// the 0x<hex> form udev uses.
+func readWWN(name string) string {
+	for _, attr := range []string{"wwid", "device/wwid"} {
+		w := strings.ToLower(sysfsValue(name, attr))
+		for _, prefix := range []string{"naa.", "eui."} {
+			if v, ok := strings.CutPrefix(w, prefix); ok {
+				return "0x" + v
+			}
+		}
+	}
+	return ""
+}
+
+// transport guesses the bus from the disk name and its sysfs device path.
+func transport(name, dev string) string {
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	case strings.Contains(dev, "/usb"):
+		return "usb"
+	case strings.Contains(dev, "/virtio"):
+		if strings.Contains(dev, "/host") {
+			// virtio-scsi, the Proxmox default controller.
+			return "scsi"
+		}
+		return "virtio"
+	case strings.Contains(dev, "/ata"):
+		return "sata"
+	case strings.Contains(dev, "/host"):
+		return "scsi"
+	}
+	return ""
+}
+
+var (
+	pciAddr = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+	ataPort = regexp.MustCompile(`/ata([0-9]+)/`)
+	hctl    = regexp.MustCompile(`^[0-9]+:[0-9]+:[0-9]+:[0-9]+$`)
+)
+
+// diskNames builds the by-id and by-path names udev would give the disk,
+// for installers running without udev.
+func diskNames(d diskInfo, dev string) (ids, paths []string) {
+	model := strings.ReplaceAll(d.model, " ", "_")
+	switch d.transport {
+	case "virtio":
+		if d.serial != "" {
+			ids = append(ids, "virtio-"+d.serial)
+		}
+	case "nvme":
+		if d.serial != "" {
+			ids = append(ids, "nvme-"+model+"_"+d.serial)
+		}
+		if w := sysfsValue(d.name, "wwid"); w != "" {
+			ids = append(ids, "nvme-"+w)
+		}
+	case "sata":
+		if d.serial != "" {
+			ids = append(ids, "ata-"+model+"_"+d.serial)
+		}
+	case "scsi", "usb":
+		if d.serial != "" {
+			ids = append(ids, "scsi-0"+strings.ReplaceAll(sysfsValue(d.name, "device/vendor"), " ", "_")+"_"+model+"_"+d.serial)
+		}
+	}
+	if d.wwn != "" {
+		ids = append(ids, "wwn-"+d.wwn)
+	}
+
+	var pci, scsi string
+	for _, part := range strings.Split(dev, "/") {
+		if pciAddr.MatchString(part) {
+			pci = part
+		}
+		if hctl.MatchString(part) {
+			scsi = part
+		}
+	}
+	if pci == "" {
+		return ids, nil
+	}
+	switch d.transport {
+	case "virtio":
+		paths = append(paths, "pci-"+pci)
+	case "nvme":
+		if ns := sysfsValue(d.name, "nsid"); ns != "" {
+			paths = append(paths, "pci-"+pci+"-nvme-"+ns)
+		}
+	case "sata":
+		if m := ataPort.FindStringSubmatch(dev); m != nil {
+			paths = append(paths, "pci-"+pci+"-ata-"+m[1], "pci-"+pci+"-ata-"+m[1]+".0")
+		}
+	case "scsi":
+		if scsi != "" {
+			paths = append(paths, "pci-"+pci+"-scsi-"+scsi)
+		}
+	}
+	return ids, paths
+}
+
+type diskLinkSet struct{ ids, paths []string }
+
+// diskLinks maps disk names to their /dev/disk/by-id and by-path links,
+// when udev or mdev created them.
+func diskLinks() map[string]diskLinkSet {
+	links := map[string]diskLinkSet{}
+	for _, kind := range []string{"by-id", "by-path"} {
+		dir := filepath.Join("/dev/disk", kind)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			target, err := filepath.EvalSymlinks(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			name := filepath.Base(target)
+			s := links[name]
+			if kind == "by-id" {
+				s.ids = append(s.ids, e.Name())
+			} else {
+				s.paths = append(s.paths, e.Name())
+			}
+			links[name] = s
+		}
+	}
+	return links
+}
+
+// describe is the detail line shown for a disk in the disk list.
+func (d diskInfo) describe() string {
+	var attrs []string
+	if d.transport != "" {
+		attrs = append(attrs, d.transport)
+	}
+	if d.rotational {
+		attrs = append(attrs, "rotational")
+	}
+	if d.removable {
+		attrs = append(attrs, "removable")
+	}
+	if d.serial != "" {
+		attrs = append(attrs, "serial "+d.serial)
+	}
+	if d.wwn != "" {
+		attrs = append(attrs, "wwn "+d.wwn)
+	}
+	if len(d.paths) > 0 {
+		attrs = append(attrs, d.paths[0])
+	}
+	switch {
+	case d.table != "":
+		attrs = append(attrs, d.table+" partition table")
+	case d.content.Type != "":
+		attrs = append(attrs, d.content.Type)
+	default:
+		attrs = append(attrs, "empty")
+	}
+	if len(d.mounts) > 0 {
+		attrs = append(attrs, "mounted on "+strings.Join(d.mounts, ", "))
+	}
+	if len(d.holders) > 0 {
+		attrs = append(attrs, "used by "+strings.Join(d.holders, ", "))
+	}
+	return strings.Join(attrs, ", ")
+}
+
+func (p partInfo) describe() string {
+	s := p.name + " " + p.size
+	if p.fstype != "" {
+		s += " " + p.fstype
+	}
+	if p.label != "" {
+		s += " \"" + p.label + "\""
+	}
+	if len(p.mounts) > 0 {
+		s += " on " + strings.Join(p.mounts, ", ")
+	}
+	return s
+}
+
+func appendUnique(list []string, vals ...string) []string {
+	for _, v := range vals {
+		found := false
+		for _, have := range list {
+			found = found || have == v
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
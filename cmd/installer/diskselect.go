@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/layout"
+)
+
+// diskRule picks the install disk in unattended installs. All set fields
+// have to match; when more than one disk is left, pick chooses the
+// smallest or largest, and without it the install fails rather than
+// guess.
+type diskRule struct {
+	name      string // vda, or /dev/vda
+	id        string // /dev/disk/by-id name, with or without the directory
+	path      string // /dev/disk/by-path name
+	serial    string
+	wwn       string
+	model     string // glob
+	minSize   uint64
+	maxSize   uint64
+	transport string
+	// rotational is "", "true" or "false".
+	rotational string
+	pick       string // "", smallest or largest
+}
+
+// Values of disk_pick.
+const (
+	pickSmallest = "smallest"
+	pickLargest  = "largest"
+)
+
+// parseDiskRule reads the disk and disk_* keys of an answer file.
+func parseDiskRule(a config.Config) (diskRule, error) {
+	r := diskRule{
+		name:      strings.TrimPrefix(a.Get("disk"), "/dev/"),
+		id:        filepath.Base(a.Get("disk_by_id")),
+		path:      filepath.Base(a.Get("disk_by_path")),
+		serial:    a.Get("disk_serial"),
+		wwn:       normalizeWWN(a.Get("disk_wwn")),
+		model:     a.Get("disk_model"),
+		transport: a.Get("disk_transport"),
+		pick:      a.Get("disk_pick"),
+	}
+	// filepath.Base("") is ".".
+	if r.id == "." {
+		r.id = ""
+	}
+	if r.path == "." {
+		r.path = ""
+	}
+	// disk=/dev/disk/by-id/... is the same as disk_by_id, and likewise
+	// for by-path.
+	if v, ok := strings.CutPrefix(r.name, "disk/by-id/"); ok {
+		if r.id != "" && r.id != v {
+			return r, fmt.Errorf("disk and disk_by_id disagree")
+		}
+		r.id, r.name = v, ""
+	}
+	if v, ok := strings.CutPrefix(r.name, "disk/by-path/"); ok {
+		if r.path != "" && r.path != v {
+			return r, fmt.Errorf("disk and disk_by_path disagree")
+		}
+		r.path, r.name = v, ""
+	}
+	var err error
+	if v := a.Get("disk_min_size"); v != "" {
+		if r.minSize, err = layout.ParseSize(v); err != nil {
+			return r, fmt.Errorf("disk_min_size: %w", err)
+		}
+	}
+	if v := a.Get("disk_max_size"); v != "" {
+		if r.maxSize, err = layout.ParseSize(v); err != nil {
+			return r, fmt.Errorf("disk_max_size: %w", err)
+		}
+	}
+	if r.model != "" {
+		if _, err := filepath.Match(r.model, ""); err != nil {
+			return r, fmt.Errorf("disk_model: %w", err)
+		}
+	}
+	if v := a.Get("disk_rotational"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return r, fmt.Errorf("disk_rotational must be true or false")
+		}
+		r.rotational = strconv.FormatBool(b)
+	}
+	switch r.transport {
+	case "", "nvme", "virtio", "sata", "scsi", "usb", "mmc":
+	default:
+		return r, fmt.Errorf("disk_transport must be nvme, virtio, sata, scsi, usb or mmc")
+	}
+	switch r.pick {
+	case "", pickSmallest, pickLargest:
+	default:
+		return r, fmt.Errorf("disk_pick must be smallest or largest")
+	}
+	if r == (diskRule{}) {
+		return r, fmt.Errorf("no disk; set disk or a disk_* rule")
+	}
+	return r, nil
+}
+
+func (r diskRule) match(d diskInfo) bool {
+	switch {
+	case r.name != "" && d.name != r.name,
+		r.id != "" && !contains(d.ids, r.id),
+		r.path != "" && !contains(d.paths, r.path),
+		r.serial != "" && d.serial != r.serial,
+		r.wwn != "" && d.wwn != r.wwn,
+		r.minSize != 0 && d.bytes < r.minSize,
+		r.maxSize != 0 && d.bytes > r.maxSize,
+		r.transport != "" && d.transport != r.transport,
+		r.rotational != "" && strconv.FormatBool(d.rotational) != r.rotational:
+		return false
+	}
+	if r.model != "" {
+		ok, _ := filepath.Match(r.model, d.model)
+		return ok
+	}
+	return true
+}
+
+// selectDisk returns the one disk the rule picks out of disks.
+func (r diskRule) selectDisk(disks []diskInfo) (diskInfo, error) {
+	var found []diskInfo
+	for _, d := range disks {
+		if r.match(d) {
+			found = append(found, d)
+		}
+	}
+	if len(found) > 1 && r.pick != "" {
+		// Only choose among disks that can be installed to.
+		var usable []diskInfo
+		for _, d := range found {
+			if checkTarget(d) == nil {
+				usable = append(usable, d)
+			}
+		}
+		found = usable
+	}
+	switch {
+	case len(found) == 0 && r.name != "":
+		if err := checkDisk(r.name); err != nil {
+			return diskInfo{}, err
+		}
+		return diskInfo{}, fmt.Errorf("%s is not an install target", r.name)
+	case len(found) == 0:
+		return diskInfo{}, fmt.Errorf("no disk matches; disks: %s", describeDisks(disks))
+	case len(found) == 1:
+		return found[0], nil
+	case r.pick == "":
+		return diskInfo{}, fmt.Errorf("%d disks match, set disk_pick or narrow the rule: %s", len(found), describeDisks(found))
+	}
+	best, tie := found[0], false
+	for _, d := range found[1:] {
+		switch {
+		case d.bytes == best.bytes:
+			tie = true
+		case (r.pick == pickSmallest) == (d.bytes < best.bytes):
+			best, tie = d, false
+		}
+	}
+	if tie {
+		return diskInfo{}, fmt.Errorf("several %s disks of %s: %s", r.pick, best.size, describeDisks(found))
+	}
+	return best, nil
+}
+
+func describeDisks(disks []diskInfo) string {
+	if len(disks) == 0 {
+		return "none"
+	}
+	var parts []string
+	for _, d := range disks {
+		s := d.name + " (" + d.size + ", " + d.model
+		if d.transport != "" {
+			s += ", " + d.transport
+		}
+		if d.serial != "" {
+			s += ", serial " + d.serial
+		}
+		parts = append(parts, s+")")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func normalizeWWN(w string) string {
+	w = strings.ToLower(strings.TrimPrefix(w, "wwn-"))
+	for _, prefix := range []string{"naa.", "eui.", "0x"} {
+		w = strings.TrimPrefix(w, prefix)
+	}
+	if w == "" {
+		return ""
+	}
+	return "0x" + w
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
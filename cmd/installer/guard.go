@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vpereira/goos/internal/blkid"
+)
+
+// isoMount is where mountISO mounts the installer media.
+const isoMount = "/mnt/iso"
+
+// checkTarget refuses disks the installer must not erase: read-only ones,
+// the one holding the installer media, and ones with mounted or otherwise
+// used partitions.
+func checkTarget(d diskInfo) error {
+	switch {
+	case d.readOnly:
+		return fmt.Errorf("%s is read-only", d.name)
+	case d.installMedia:
+		return fmt.Errorf("%s holds the installer media", d.name)
+	case len(d.mounts) > 0:
+		return fmt.Errorf("%s is mounted on %s", d.name, strings.Join(d.mounts, ", "))
+	case len(d.holders) > 0:
+		return fmt.Errorf("%s is in use by %s", d.name, strings.Join(d.holders, ", "))
+	}
+	for _, p := range d.parts {
+		if len(p.mounts) > 0 {
+			return fmt.Errorf("%s is mounted on %s", p.name, strings.Join(p.mounts, ", "))
+		}
+	}
+	return nil
+}
+
+// checkDisk re-reads a disk from sysfs and runs checkTarget on it, right
+// before it is erased.
+func checkDisk(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+		return fmt.Errorf("disk %s not found", name)
+	}
+	return checkTarget(readDisk(name, readMounts()))
+}
+
+// installMediaDisk returns the disk the installer media is mounted from,
+// or "".
+func installMediaDisk(mounts map[string][]string) string {
+	for name, targets := range mounts {
+		if contains(targets, isoMount) {
+			return parentDisk(name)
+		}
+	}
+	return ""
+}
+
+// parentDisk maps a partition name to its disk.
+func parentDisk(name string) string {
+	if _, err := os.Stat(filepath.Join("/sys/block", name)); err == nil {
+		return name
+	}
+	dev, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return name
+	}
+	return filepath.Base(filepath.Dir(dev))
+}
+
+// hasData reports whether the disk has a partition table, partitions or a
+// filesystem on it.
+func hasData(d diskInfo) bool {
+	return d.table != "" || d.content.Type != "" || len(d.parts) > 0
+}
+
+// printContents shows what erasing the disk destroys: its partitions and
+// the signatures wipefs would find.
+func printContents(d diskInfo) {
+	if !hasData(d) {
+		fmt.Printf("`%s` looks empty.\n", d.name)
+		return
+	}
+	fmt.Printf("Existing data on `%s`:\n", d.name)
+	fmt.Println()
+	for _, p := range d.parts {
+		fmt.Printf("- %s\n", p.describe())
+	}
+	sigs, _ := blkid.ProbeFile(filepath.Join("/dev", d.name))
+	for _, s := range sigs {
+		line := fmt.Sprintf("- %s signature at offset %#x", s.Type, s.Offset)
+		if s.Label != "" {
+			line += fmt.Sprintf(" (label %q)", s.Label)
+		}
+		fmt.Println(line)
+	}
+}
+
+// confirmErase asks before the disk is erased. A disk with data on it has
+// to be confirmed by typing its name.
+func confirmErase(r *bufio.Reader, d diskInfo) bool {
+	printContents(d)
+	fmt.Println()
+	fmt.Println("> WARNING: All data on the selected disk will be permanently deleted.")
+	if !hasData(d) {
+		return promptYesNo(r, "Proceed with erase?", false)
+	}
+	return promptLine(r, fmt.Sprintf("Type `%s` to erase it", d.name)) == d.name
+}
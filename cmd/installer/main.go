@@ -17,21 +17,29 @@ import (
 	diskpkg "github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/efivar"
+	"github.com/vpereira/goos/internal/layout"
+	"github.com/vpereira/goos/internal/passwd"
+	"github.com/vpereira/goos/internal/secrets"
+	"github.com/vpereira/goos/internal/slots"
 	"golang.org/x/term"
 )
 
 var version = "dev"
 
-type diskInfo struct {
-	name  string
-	size  string
-	model string
-}
-
 func main() {
 	_ = os.Setenv("PATH", "/bbin:/bin:/usr/bin:/sbin:/usr/sbin")
 	mountBasics()
+	if src, ok := cmdline.Value("goos.autoinstall"); ok && src != "" {
+		os.Exit(autoInstall(src))
+	}
 	reader := bufio.NewReader(os.Stdin)
+	// Mount the installer media first so the disk holding it is known.
+	_ = mountISO()
 	disks := detectDisks()
 
 	printHeader()
@@ -40,19 +48,50 @@ func main() {
 	fmt.Println()
 	fmt.Println("Detected disks:")
 	fmt.Println()
+	defDisk := 0
 	for i, d := range disks {
 		fmt.Printf("%d. `%s` — `%s` — `%s`\n", i+1, d.name, d.size, d.model)
+		if d.bytes != 0 {
+			fmt.Printf("   %s\n", d.describe())
+		}
+		for _, p := range d.parts {
+			fmt.Printf("   - %s\n", p.describe())
+		}
+		if err := checkTarget(d); err != nil {
+			fmt.Printf("   (cannot install: %v)\n", err)
+		} else if defDisk == 0 {
+			defDisk = i + 1
+		}
 	}
 	fmt.Println()
+	if defDisk == 0 {
+		fmt.Println("No disk can be installed to.")
+		return
+	}
 
-	diskIndex := promptIndex(reader, "Select disk to erase and install to", len(disks), 1)
+	var diskIndex int
+	for {
+		diskIndex = promptIndex(reader, "Select disk to erase and install to", len(disks), defDisk)
+		err := checkTarget(disks[diskIndex-1])
+		if err == nil {
+			break
+		}
+		fmt.Printf("Cannot install to this disk: %v\n", err)
+	}
 	fmt.Println()
-	fmt.Println("> WARNING: All data on the selected disk will be permanently deleted.")
-	if !promptYesNo(reader, "Proceed with erase?", false) {
+	if !confirmErase(reader, disks[diskIndex-1]) {
 		fmt.Println()
 		fmt.Println("Installation cancelled.")
 		return
 	}
+	fmt.Println()
+	fmt.Println("How to wipe the disk:")
+	fmt.Println()
+	fmt.Println("1. Erase signatures (fast)")
+	fmt.Println("2. Erase signatures and discard (TRIM) the whole disk")
+	fmt.Println("3. Erase signatures and zero-fill the whole disk (slow)")
+	fmt.Println()
+	wipeMode := []string{wipeSignatures, wipeDiscard, wipeZero}[promptIndex(reader, "Select wipe mode", 3, 1)-1]
 
 	fmt.Println()
 	fmt.Println("---")
@@ -107,6 +146,15 @@ func main() {
 	rootPass := promptPassword(reader)
 	fmt.Println()
 	fmt.Println("(Leave empty to disable password login and require SSH key / console-only access.)")
+	rootPassHash := ""
+	if rootPass != "" {
+		h, err := passwd.Hash(rootPass)
+		if err != nil {
+			fmt.Printf("ERROR: hash password: %v\n", err)
+			waitForever()
+		}
+		rootPassHash = h
+	}
 
 	fmt.Println()
 	fmt.Println("---")
@@ -138,12 +186,69 @@ func main() {
 	fmt.Println()
 	fmt.Println("---")
 	fmt.Println()
-	fmt.Println("### 6) Summary")
+	fmt.Println("### 6) Root filesystem")
+	fmt.Println()
+	fmt.Println("1. Run from the initramfs (default)")
+	fmt.Println("2. Install an ext4 root partition")
+	fmt.Println()
+	rootFS := promptIndex(reader, "Select [1-2]", 2, 1) == 2
+	fmt.Println()
+	fmt.Println("Partition layout: a preset (default, root, ab, swap) or")
+	fmt.Println("role:size[:label[:type]],... with roles esp, boot-a, boot-b, root,")
+	fmt.Println("state and swap, and sizes like 512M, 20% or rest.")
+	fmt.Println()
+	layoutDefault := "default"
+	if rootFS {
+		layoutDefault = "root"
+	}
+	var spec layout.Spec
+	for {
+		v := promptLine(reader, fmt.Sprintf("Layout (default: %s)", layoutDefault))
+		var err error
+		if spec, err = layout.ParseSpec(orDefault(v, layoutDefault)); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if spec.Has(layout.RoleRoot) != rootFS {
+			fmt.Println("The layout needs a root partition exactly when installing an ext4 root.")
+			continue
+		}
+		break
+	}
+
+	fmt.Println()
+	fmt.Println("---")
+	fmt.Println()
+	fmt.Println("### 7) Boot firmware")
+	fmt.Println()
+	fmt.Println("1. UEFI")
+	fmt.Println("2. Legacy BIOS")
+	fmt.Println("3. Both (hybrid)")
+	fmt.Println()
+	bootModes := []string{bootUEFI, bootBIOS, bootHybrid}
+	bootDefault := 1
+	if defaultBootMode() == bootBIOS {
+		bootDefault = 2
+	}
+	bootMode := bootModes[promptIndex(reader, "Select [1-3]", 3, bootDefault)-1]
+
+	fmt.Println()
+	fmt.Println("---")
+	fmt.Println()
+	fmt.Println("### 8) Summary")
 	fmt.Println()
 	fmt.Printf("Install target: `%s`\n", disks[diskIndex-1].name)
+	fmt.Printf("Wipe: `%s`\n", wipeLabel(wipeMode))
+	fmt.Printf("Boot: `%s`\n", bootLabel(bootMode))
+	fmt.Printf("Root filesystem: `%s`\n", rootLabel(rootFS))
+	fmt.Printf("Layout: `%s`\n", spec)
 	fmt.Printf("Network: `%s`\n", networkMode)
 	fmt.Printf("SSH: `%s`\n", boolLabel(sshEnabled))
 	fmt.Printf("Role: `%s`\n", role)
+	if role != "none" {
+		fmt.Printf("Master URL: `%s`\n", masterURL)
+		fmt.Printf("Join token: `%s`\n", secrets.Redact(joinToken))
+	}
 	fmt.Println()
 
 	if !promptYesNo(reader, "Proceed with installation?", false) {
@@ -153,28 +258,35 @@ func main() {
 	}
 
 	cfg := installerConfig{
-		Disk:        disks[diskIndex-1].name,
-		Network:     networkMode,
-		StaticIPv4:  staticIPv4,
-		StaticGW:    staticGW,
-		StaticDNS:   staticDNS,
-		SSHEnabled:  sshEnabled,
-		SSHKey:      sshKey,
-		RootPass:    rootPass,
-		Role:        role,
-		MasterURL:   masterURL,
-		JoinToken:   joinToken,
+		Disk:         disks[diskIndex-1].name,
+		Network:      networkMode,
+		StaticIPv4:   staticIPv4,
+		StaticGW:     staticGW,
+		StaticDNS:    staticDNS,
+		SSHEnabled:   sshEnabled,
+		SSHKey:       sshKey,
+		RootPassHash: rootPassHash,
+		Role:         role,
+		MasterURL:    masterURL,
+		JoinToken:    joinToken,
+		RootFS:       rootFS,
+		Boot:         bootMode,
+		Wipe:         wipeMode,
+		Layout:       spec,
 	}
 
 	fmt.Println()
 	fmt.Println("Installing…")
 	fmt.Println()
 	fmt.Println("* Partitioning disk…")
-	fmt.Println("* Formatting ext4… (skipped)")
+	if rootFS {
+		fmt.Println("* Populating ext4 root partition…")
+	}
+	fmt.Println("* Formatting ext4 state partition…")
 	fmt.Println("* Writing boot files…")
 	fmt.Println("* Writing configuration…")
 
-	if err := installUEFI(cfg); err != nil {
+	if err := installDisk(cfg); err != nil {
 		fmt.Println()
 		fmt.Printf("ERROR: %v\n", err)
 		waitForever()
@@ -200,66 +312,6 @@ func printHeader() {
 	fmt.Println()
 }
 
-func detectDisks() []diskInfo {
-	entries, err := os.ReadDir("/sys/block")
-	if err != nil {
-		return nil
-	}
-	var disks []diskInfo
-	for _, e := range entries {
-		name := e.Name()
-		if skipDisk(name) {
-			continue
-		}
-		size := readSize(name)
-		model := readModel(name)
-		disks = append(disks, diskInfo{name: name, size: size, model: model})
-	}
-	if len(disks) == 0 {
-		disks = append(disks, diskInfo{name: "unknown", size: "0", model: "unknown"})
-	}
-	return disks
-}
-
-func skipDisk(name string) bool {
-	for _, prefix := range []string{"loop", "ram", "sr", "fd"} {
-		if strings.HasPrefix(name, prefix) {
-			return true
-		}
-	}
-	return false
-}
-
-func readSize(name string) string {
-	b, err := os.ReadFile(filepath.Join("/sys/block", name, "size"))
-	if err != nil {
-		return "unknown"
-	}
-	sec, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
-	if err != nil {
-		return "unknown"
-	}
-	bytes := sec * 512
-	gib := float64(bytes) / (1024 * 1024 * 1024)
-	if gib >= 1 {
-		return fmt.Sprintf("%.1fG", gib)
-	}
-	mb := float64(bytes) / (1024 * 1024)
-	return fmt.Sprintf("%.0fM", mb)
-}
-
-func readModel(name string) string {
-	modelPath := filepath.Join("/sys/block", name, "device", "model")
-	b, err := os.ReadFile(modelPath)
-	if err == nil {
-		m := strings.TrimSpace(string(b))
-		if m != "" {
-			return m
-		}
-	}
-	return "unknown"
-}
-
 func promptIndex(r *bufio.Reader, label string, max, def int) int {
 	for {
 		fmt.Printf("%s [%d-%d] (default: %d): ", label, 1, max, def)
@@ -312,6 +364,13 @@ func promptYesNo(r *bufio.Reader, label string, def bool) bool {
 	}
 }
 
+func rootLabel(ext4 bool) string {
+	if ext4 {
+		return "ext4"
+	}
+	return "initramfs"
+}
+
 func boolLabel(v bool) string {
 	if v {
 		return "enabled"
@@ -352,20 +411,50 @@ func readPassword(r *bufio.Reader) (string, error) {
 }
 
 type installerConfig struct {
-	Disk       string
-	Network    string
-	StaticIPv4 string
-	StaticGW   string
-	StaticDNS  string
-	SSHEnabled bool
-	SSHKey     string
-	RootPass   string
-	Role       string
-	MasterURL  string
-	JoinToken  string
-}
-
-func installUEFI(cfg installerConfig) error {
+	Disk         string
+	Network      string
+	StaticIPv4   string
+	StaticGW     string
+	StaticDNS    string
+	SSHEnabled   bool
+	SSHKey       string
+	RootPassHash string
+	Role         string
+	MasterURL    string
+	JoinToken    string
+	// Secrets is the sealed form of JoinToken written to disk.
+	Secrets string
+	// RootFS installs the userland on an ext4 partition that goos-init
+	// switches into; RootUUID is its PARTUUID.
+	RootFS   bool
+	RootUUID string
+	// Boot is bootUEFI, bootBIOS or bootHybrid.
+	Boot string
+	// Wipe is wipeSignatures, wipeDiscard or wipeZero.
+	Wipe string
+	// Layout is the partition layout; nil means layout.DefaultSpec.
+	Layout layout.Spec
+}
+
+// installDisk partitions the disk, writes the ESP and makes it bootable
+// for cfg.Boot.
+func installDisk(cfg installerConfig) error {
+	if err := checkDisk(cfg.Disk); err != nil {
+		return fmt.Errorf("refusing to install: %w", err)
+	}
+	// Verify what will be installed before anything on the disk is touched.
+	files, err := loadBootFiles()
+	if err != nil {
+		return err
+	}
+	// Boot partitions back up the A/B slots, which BIOS-only and UKI
+	// installs do not have.
+	if cfg.Layout.Has(layout.RoleBootA) && (cfg.Boot == bootBIOS || files.uki != nil) {
+		return fmt.Errorf("boot A/B partitions need the boot slots, which BIOS-only and UKI installs do not use")
+	}
+	if err := wipeDisk(cfg.Disk, cfg.Wipe); err != nil {
+		return fmt.Errorf("wipe disk: %w", err)
+	}
 	diskPath := filepath.Join("/dev", cfg.Disk)
 	disk, err := diskfs.Open(
 		diskPath,
@@ -384,28 +473,36 @@ func installUEFI(cfg installerConfig) error {
 	if physSize == 0 {
 		physSize = int64(sectorSize)
 	}
-	start := uint64(2048)
 	totalSectors := uint64(disk.Size) / sectorSize
-	espStart := start
-	espEnd := totalSectors - 2048
-	if espEnd <= espStart {
-		return fmt.Errorf("disk too small for EFI install")
+	spec := cfg.Layout
+	if spec == nil {
+		spec = layout.DefaultSpec(cfg.RootFS)
+	}
+	parts, err := planPartitions(spec, totalSectors, sectorSize, diskAlignment(cfg.Disk, sectorSize))
+	if err != nil {
+		return err
+	}
+	if cfg.Boot != bootUEFI {
+		parts[0].Attributes |= legacyBootable
+	}
+	if i := spec.Index(layout.RoleRoot); i >= 0 {
+		if _, err := exec.LookPath("mke2fs"); err != nil {
+			return fmt.Errorf("ext4 root needs mke2fs: %w", err)
+		}
+		cfg.RootFS, cfg.RootUUID = true, parts[i].GUID
+	} else if cfg.RootFS {
+		return fmt.Errorf("an ext4 root needs a root partition in the layout")
 	}
 	fmt.Printf("DEBUG: disk size=%d bytes logical=%d physical=%d\n", disk.Size, sectorSize, physSize)
-	fmt.Printf("DEBUG: GPT esp start=%d end=%d total=%d\n", espStart, espEnd, totalSectors)
+	for i, p := range parts {
+		fmt.Printf("DEBUG: GPT part %d %q start=%d end=%d total=%d\n", i+1, p.Name, p.Start, p.End, totalSectors)
+	}
 
 	table := &gpt.Table{
 		LogicalSectorSize:  int(sectorSize),
 		PhysicalSectorSize: int(physSize),
 		ProtectiveMBR:      true,
-		Partitions: []*gpt.Partition{
-			{
-				Start: espStart,
-				End:   espEnd,
-				Type:  gpt.EFISystemPartition,
-				Name:  "EFI System",
-			},
-		},
+		Partitions:         parts,
 	}
 	if err := disk.Partition(table); err != nil {
 		return fmt.Errorf("partition disk: %w", err)
@@ -422,74 +519,347 @@ func installUEFI(cfg installerConfig) error {
 	if err != nil {
 		return fmt.Errorf("format EFI partition: %w", err)
 	}
-
-	if err := copyBootFiles(espFS); err != nil {
+	if err := copyBootFiles(espFS, cfg, files); err != nil {
+		return err
+	}
+	sealed, err := sealSecrets(espFS, cfg)
+	if err != nil {
 		return err
 	}
+	cfg.Secrets = sealed
 	if err := writeConfigToFS(espFS, cfg); err != nil {
 		return err
 	}
 	_ = espFS.Close()
 	syscall.Sync()
 
-	if err := verifyESP(diskPath); err != nil {
+	if err := verifyESP(diskPath, cfg); err != nil {
 		return err
 	}
+	for i, p := range spec {
+		dev := partDevice(cfg.Disk, i+1)
+		switch p.Role {
+		case layout.RoleRoot:
+			if err := populateRoot(dev, cfg, files.initrd); err != nil {
+				return err
+			}
+		case layout.RoleBootA, layout.RoleBootB:
+			if err := writeBootPartition(disk, i+1, p.Label, files); err != nil {
+				return fmt.Errorf("%s partition: %w", p.Role, err)
+			}
+		case layout.RoleState:
+			formatState(dev, p.Label)
+		case layout.RoleSwap:
+			if err := formatSwap(dev, p.Label); err != nil {
+				return fmt.Errorf("format swap partition: %w", err)
+			}
+		}
+	}
+	if cfg.Boot != bootUEFI {
+		if err := installBIOS(cfg.Disk, cfg.Boot); err != nil {
+			return err
+		}
+	}
+	if cfg.Boot != bootBIOS {
+		esp := parts[0]
+		addBootEntry(efivar.HardDrive{Number: 1, Start: esp.Start, Size: esp.End - esp.Start + 1, GUID: esp.GUID})
+	}
 
 	return nil
 }
 
-func copyBootFiles(esp filesystem.FileSystem) error {
-	if err := mountISO(); err != nil {
+// addBootEntry points a "GOOS" NVRAM boot entry at the installed ESP and
+// puts it first in BootOrder, so firmware does not depend on finding the
+// removable-media path on the right disk. It only warns on failure, since
+// that path still works on most firmware.
+func addBootEntry(esp efivar.HardDrive) {
+	if !efivar.Supported() {
+		fmt.Println("* Not booted through UEFI; skipping NVRAM boot entry")
+		return
+	}
+	if err := efivar.Mount(); err != nil {
+		fmt.Printf("WARN: mount efivarfs: %v; skipping NVRAM boot entry\n", err)
+		return
+	}
+	num, err := efivar.SetBootEntry(efivar.LoadOption{
+		Description: "GOOS",
+		Partition:   esp,
+		Path:        `\EFI\BOOT\BOOTX64.EFI`,
+	})
+	if err != nil {
+		fmt.Printf("WARN: NVRAM boot entry: %v\n", err)
+		return
+	}
+	fmt.Printf("* Added UEFI boot entry Boot%04X and made it first in BootOrder\n", num)
+}
+
+// formatState makes the ext4 state filesystem. go-diskfs cannot write a
+// valid ext4 yet, so this needs mke2fs; without it goos-init formats the
+// partition on first boot. goos-init only formats a blank partition, so
+// the start is zeroed first in case the disk held data there before.
+func formatState(dev, label string) {
+	waitDevice(dev)
+	if err := zeroStart(dev, layout.StateBlank); err != nil {
+		fmt.Printf("WARN: clear state partition: %v\n", err)
+	}
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		fmt.Println("WARN: mke2fs not found; state partition will be formatted on first boot")
+		return
+	}
+	if err := runCmd("mke2fs", "-q", "-F", "-t", "ext4", "-L", label, dev); err != nil {
+		fmt.Printf("WARN: format state partition: %v; retrying on first boot\n", err)
+	}
+}
+
+// zeroStart overwrites the first n bytes of dev.
+func zeroStart(dev string, n int) error {
+	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
 		return err
 	}
-	efi, err := os.ReadFile("/systemd-bootx64.efi")
+	defer f.Close()
+	if _, err := f.WriteAt(make([]byte, n), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// populateRoot formats the root partition and unpacks the GOOS userland
+// from the verified initramfs into it, plus a copy of the config. goos-init
+// on the ESP's initramfs switches into it when root= is set.
+func populateRoot(dev string, cfg installerConfig, initrd []byte) error {
+	waitDevice(dev)
+	if err := runCmd("mke2fs", "-q", "-F", "-t", "ext4", "-L", layout.RootName, dev); err != nil {
+		return fmt.Errorf("format root partition: %w", err)
+	}
+	loadExt4Modules()
+	const target = "/mnt/root"
+	_ = os.MkdirAll(target, 0o755)
+	if err := syscall.Mount(dev, target, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("mount root partition: %w", err)
+	}
+	defer syscall.Unmount(target, 0)
+
+	// Unpack the initramfs loadBootFiles verified, not the file on the ISO.
+	rr := cpio.EOFReader{RecordReader: cpio.Newc.Reader(bytes.NewReader(initrd))}
+	n := 0
+	err := cpio.ForEachRecord(rr, func(r cpio.Record) error {
+		if r.Name == "TRAILER!!!" {
+			return nil
+		}
+		n++
+		return cpio.CreateFileInRoot(r, target, false)
+	})
 	if err != nil {
-		return fmt.Errorf("read systemd-bootx64.efi: %w", err)
+		return fmt.Errorf("unpack userland: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(target, "etc"), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(target, config.Path), []byte(configText(cfg)), 0o600); err != nil {
+		return fmt.Errorf("write root config: %w", err)
+	}
+	syscall.Sync()
+	fmt.Printf("* Unpacked %d files into the root partition\n", n)
+	return nil
+}
+
+func loadExt4Modules() {
+	kver := kernelRelease()
+	if kver == "" {
+		return
+	}
+	for _, rel := range []string{"lib/crc16.ko", "fs/mbcache.ko", "fs/jbd2/jbd2.ko", "fs/ext4/ext4.ko"} {
+		mod := filepath.Join("/lib/modules", kver, "kernel", rel)
+		if _, err := os.Stat(mod); err == nil {
+			_ = runCmd("insmod", mod)
+		}
+	}
+}
+
+// waitDevice gives the kernel time to create a partition node after the
+// partition table is re-read.
+func waitDevice(dev string) {
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(dev); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// partDevice names partition n of disk, e.g. sda2 or nvme0n1p2.
+func partDevice(disk string, n int) string {
+	dev := filepath.Join("/dev", disk)
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		dev += "p"
+	}
+	return dev + strconv.Itoa(n)
+}
+
+// bootFiles are the ISO's boot files, read and verified against its signed
+// manifest before the target disk is written.
+type bootFiles struct {
+	kernel, initrd []byte
+	uki            []byte // nil unless the manifest lists one
+	m              *bundle.Manifest
+	manifest, sig  []byte
+}
+
+// loadBootFiles reads the boot files from the ISO and verifies them.
+func loadBootFiles() (*bootFiles, error) {
+	if err := mountISO(); err != nil {
+		return nil, err
 	}
 	kernel, err := os.ReadFile("/mnt/iso/boot/vmlinuz")
 	if err != nil {
-		return fmt.Errorf("read vmlinuz: %w", err)
+		return nil, fmt.Errorf("read vmlinuz: %w", err)
 	}
 	initrd, err := os.ReadFile("/mnt/iso/boot/initramfs.cpio")
 	if err != nil {
-		return fmt.Errorf("read initramfs.cpio: %w", err)
+		return nil, fmt.Errorf("read initramfs.cpio: %w", err)
+	}
+	m, manifest, sig, err := verifyBootFiles(kernel, initrd)
+	if err != nil {
+		return nil, err
 	}
+	f := &bootFiles{kernel: kernel, initrd: initrd, m: m, manifest: manifest, sig: sig}
+	if _, ok := m.Files[bundle.UKIName]; ok {
+		if f.uki, err = os.ReadFile(filepath.Join("/mnt/iso/boot", bundle.UKIName)); err != nil {
+			return nil, fmt.Errorf("read %s: %w", bundle.UKIName, err)
+		}
+		if err := m.Check(bundle.UKIName, bytes.NewReader(f.uki)); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
 
+func copyBootFiles(esp filesystem.FileSystem, cfg installerConfig, f *bootFiles) error {
+	kernel, initrd, manifest, sig := f.kernel, f.initrd, f.manifest, f.sig
+	options := "console=ttyS0 panic=10"
+	if cfg.RootUUID != "" {
+		options += " root=PARTUUID=" + cfg.RootUUID
+	}
+	// A hybrid install with slots boots them from syslinux too, so updates
+	// reach BIOS boots; a UKI is not A/B updated and keeps its own copy.
+	if cfg.Boot == bootBIOS || cfg.Boot == bootHybrid && f.uki != nil {
+		if err := writeBIOSFiles(esp, kernel, initrd, options); err != nil {
+			return err
+		}
+		if cfg.Boot == bootBIOS {
+			return nil
+		}
+	}
+
+	efi, err := os.ReadFile("/systemd-bootx64.efi")
+	if err != nil {
+		return fmt.Errorf("read systemd-bootx64.efi: %w", err)
+	}
 	if err := mkdirAll(esp, "/EFI/BOOT"); err != nil {
 		return err
 	}
 	if err := writeFile(esp, "/EFI/BOOT/BOOTX64.EFI", efi); err != nil {
 		return err
 	}
-	if err := writeFile(esp, "/vmlinuz", kernel); err != nil {
-		return err
+	if f.uki != nil {
+		return installUKI(esp, f.uki)
 	}
-	if err := writeFile(esp, "/initramfs.cpio", initrd); err != nil {
+	// Both slots start with the same files so there is always one to fall
+	// back to. Slot a is newer and has to prove itself within slots.Tries
+	// boots; slot b is already blessed, so syslinux boots it until goos-init
+	// blesses slot a.
+	if err := mkdirAll(esp, slots.EntriesDir); err != nil {
 		return err
 	}
-	if err := mkdirAll(esp, "/loader/entries"); err != nil {
-		return err
+	for _, slot := range []struct {
+		name    string
+		version int
+		tries   int
+	}{
+		{slots.A, 2, slots.Tries},
+		{slots.B, 1, 0},
+	} {
+		if err := mkdirAll(esp, slots.Dir(slot.name)); err != nil {
+			return err
+		}
+		if err := writeFile(esp, slots.Kernel(slot.name), kernel); err != nil {
+			return err
+		}
+		if err := writeFile(esp, slots.Initrd(slot.name), initrd); err != nil {
+			return err
+		}
+		if err := writeFile(esp, slots.Dir(slot.name)+"/"+bundle.ManifestName, manifest); err != nil {
+			return err
+		}
+		if err := writeFile(esp, slots.Dir(slot.name)+"/"+bundle.SignatureName, sig); err != nil {
+			return err
+		}
+		entry := slots.EntryConf(slot.name, slot.version, options)
+		if err := writeFile(esp, slots.EntriesDir+"/"+slots.EntryName(slot.name, slot.tries), []byte(entry)); err != nil {
+			return err
+		}
+	}
+	if cfg.Boot == bootHybrid {
+		if err := writeSyslinuxConf(esp, slots.Kernel(slots.B), slots.Initrd(slots.B), options); err != nil {
+			return err
+		}
+	}
+	return writeFile(esp, "/loader/loader.conf", []byte(slots.LoaderConf))
+}
+
+// verifyBootFiles checks the kernel and initramfs read from the ISO against
+// its signed manifest and returns the manifest and signature to keep with
+// each slot. Boot files not signed by the trust root are never installed.
+func verifyBootFiles(kernel, initrd []byte) (*bundle.Manifest, []byte, []byte, error) {
+	pub, err := bundle.LoadPublicKey(bundle.TrustRoot)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("trust root: %w", err)
+	}
+	manifest, err := os.ReadFile(filepath.Join("/mnt/iso/boot", bundle.ManifestName))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("boot files are not signed: %w", err)
+	}
+	sig, err := os.ReadFile(filepath.Join("/mnt/iso/boot", bundle.SignatureName))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("boot files are not signed: %w", err)
+	}
+	if err := bundle.Verify(pub, manifest, sig); err != nil {
+		return nil, nil, nil, err
 	}
+	m, err := bundle.Parse(manifest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := m.Check(bundle.KernelName, bytes.NewReader(kernel)); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := m.Check(bundle.InitrdName, bytes.NewReader(initrd)); err != nil {
+		return nil, nil, nil, err
+	}
+	fmt.Printf("* Verified signed boot files, version %s\n", m.Version)
+	return m, manifest, sig, nil
+}
 
-	loaderConf := "default goos\n" +
-		"timeout 0\n" +
-		"editor no\n"
-	entryConf := "title GOOS\n" +
-		"linux /vmlinuz\n" +
-		"initrd /initramfs.cpio\n" +
-		"options console=ttyS0 goos.shell=1\n"
+// ukiPath is where systemd-boot discovers the unified kernel image.
+const ukiPath = "/EFI/Linux/" + bundle.UKIName
 
-	if err := writeFile(esp, "/loader/loader.conf", []byte(loaderConf)); err != nil {
+// installUKI installs the ISO's unified kernel image instead of the slot
+// entries. Its cmdline is sealed into the image, so there are no options
+// to edit at the boot menu; the root partition is found by name through
+// goos.root=auto. It is not A/B updated.
+func installUKI(esp filesystem.FileSystem, img []byte) error {
+	if err := mkdirAll(esp, "/EFI/Linux"); err != nil {
 		return err
 	}
-	if err := writeFile(esp, "/loader/entries/goos.conf", []byte(entryConf)); err != nil {
+	if err := writeFile(esp, ukiPath, img); err != nil {
 		return err
 	}
-	return nil
+	fmt.Println("* Installed unified kernel image " + ukiPath)
+	return writeFile(esp, "/loader/loader.conf", []byte("default "+bundle.UKIName+"\ntimeout 0\neditor no\n"))
 }
 
-func verifyESP(diskPath string) error {
+func verifyESP(diskPath string, cfg installerConfig) error {
 	disk, err := diskfs.Open(
 		diskPath,
 		diskfs.WithOpenMode(diskfs.ReadOnly),
@@ -505,15 +875,22 @@ func verifyESP(diskPath string) error {
 	if err != nil {
 		return fmt.Errorf("verify ESP: read filesystem: %w", err)
 	}
-	f, err := fs.OpenFile("/EFI/BOOT/BOOTX64.EFI", os.O_RDONLY)
+	want := "/EFI/BOOT/BOOTX64.EFI"
+	if cfg.Boot == bootBIOS {
+		want = slots.SyslinuxConf
+	}
+	f, err := fs.OpenFile(want, os.O_RDONLY)
 	if err != nil {
-		return fmt.Errorf("verify ESP: missing BOOTX64.EFI: %w", err)
+		return fmt.Errorf("verify ESP: missing %s: %w", want, err)
 	}
 	_ = f.Close()
 	return nil
 }
 
 func mountISO() error {
+	if _, err := os.Stat("/mnt/iso/boot/vmlinuz"); err == nil {
+		return nil
+	}
 	loadISOModules()
 	_ = os.MkdirAll("/mnt/iso", 0o755)
 	debugBlockDevices()
@@ -693,13 +1070,45 @@ func configText(cfg installerConfig) string {
 	fmt.Fprintf(&b, "static_dns=%s\n", cfg.StaticDNS)
 	fmt.Fprintf(&b, "ssh_enabled=%t\n", cfg.SSHEnabled)
 	fmt.Fprintf(&b, "ssh_key=%s\n", cfg.SSHKey)
-	fmt.Fprintf(&b, "root_password=%s\n", cfg.RootPass)
+	fmt.Fprintf(&b, "root_password_hash=%s\n", cfg.RootPassHash)
 	fmt.Fprintf(&b, "role=%s\n", cfg.Role)
 	fmt.Fprintf(&b, "master_url=%s\n", cfg.MasterURL)
-	fmt.Fprintf(&b, "join_token=%s\n", cfg.JoinToken)
+	fmt.Fprintf(&b, "secrets=%s\n", cfg.Secrets)
 	return b.String()
 }
 
+// sealSecrets encrypts the join token for the config. Without a fw_cfg or
+// cmdline secret a per-node key is generated and stored on the ESP.
+func sealSecrets(fs filesystem.FileSystem, cfg installerConfig) (string, error) {
+	if cfg.JoinToken == "" {
+		return "", nil
+	}
+	material, src, ok := secrets.ExternalKey()
+	if !ok {
+		var err error
+		if material, err = secrets.NewNodeKey(); err != nil {
+			return "", fmt.Errorf("generate node key: %w", err)
+		}
+		if err := mkdirAll(fs, "/goos"); err != nil {
+			return "", err
+		}
+		if err := writeFile(fs, secrets.NodeKeyPath, material); err != nil {
+			return "", fmt.Errorf("write node key: %w", err)
+		}
+		src = "node key"
+	}
+	key, err := secrets.DeriveKey(material)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := secrets.Seal(key, config.Config{"join_token": cfg.JoinToken})
+	if err != nil {
+		return "", fmt.Errorf("seal secrets: %w", err)
+	}
+	fmt.Printf("* Sealed secrets (key from %s)\n", src)
+	return sealed, nil
+}
+
 func waitForever() {
 	for {
 		time.Sleep(10 * time.Second)
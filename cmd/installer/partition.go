@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	diskpkg "github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/layout"
+)
+
+// diskAlignment returns the partition alignment in sectors. Like parted,
+// it uses 1 MiB unless the disk reports an optimal I/O size that is a
+// multiple of its physical block size and a multiple of 1 MiB; RAID
+// stripes that fit neither are ignored rather than inflating the
+// alignment.
+func diskAlignment(disk string, sectorSize uint64) uint64 {
+	const mib = 1 << 20
+	align := uint64(mib)
+	phys, _ := strconv.ParseUint(sysfsValue(disk, "queue/physical_block_size"), 10, 64)
+	opt, _ := strconv.ParseUint(sysfsValue(disk, "queue/optimal_io_size"), 10, 64)
+	if phys == 0 {
+		phys = sectorSize
+	}
+	// An optimal I/O size that divides 1 MiB is already honoured by it.
+	if opt > mib && opt%phys == 0 && opt%mib == 0 {
+		align = opt
+	}
+	return align / sectorSize
+}
+
+// planPartitions places the layout on a disk of totalSectors, each
+// partition starting and ending on align. The last MiB stays free for the
+// backup GPT.
+func planPartitions(spec layout.Spec, totalSectors, sectorSize, align uint64) ([]*gpt.Partition, error) {
+	first := align
+	tail := uint64(1<<20) / sectorSize
+	if totalSectors < first+tail {
+		return nil, fmt.Errorf("disk too small to install")
+	}
+	limit := (totalSectors - tail) / align * align
+	avail := limit - first
+
+	sizes := make([]uint64, len(spec))
+	rest := -1
+	var used uint64
+	for i, p := range spec {
+		switch {
+		case p.Rest():
+			rest = i
+			continue
+		case p.Percent != 0:
+			sizes[i] = avail * uint64(p.Percent) / 100 / align * align
+		default:
+			sizes[i] = (p.Size + sectorSize - 1) / sectorSize
+			sizes[i] = (sizes[i] + align - 1) / align * align
+		}
+		if sizes[i] == 0 {
+			return nil, fmt.Errorf("%s partition rounds down to nothing", p.Role)
+		}
+		used += sizes[i]
+	}
+	if rest >= 0 {
+		if used+align > avail {
+			return nil, fmt.Errorf("disk too small to install (need %d MiB)", (first+used+align+tail)*sectorSize>>20)
+		}
+		sizes[rest] = avail - used
+	} else if used > avail {
+		return nil, fmt.Errorf("disk too small to install (need %d MiB)", (first+used+tail)*sectorSize>>20)
+	}
+
+	var parts []*gpt.Partition
+	next := first
+	for i, p := range spec {
+		parts = append(parts, &gpt.Partition{
+			Start: next,
+			End:   next + sizes[i] - 1,
+			Type:  gpt.Type(p.Type),
+			Name:  p.Label,
+			GUID:  strings.ToUpper(uuid.NewString()),
+		})
+		next += sizes[i]
+	}
+	return parts, nil
+}
+
+// writeBootPartition formats a boot partition as FAT and puts the slot
+// files the ESP got on it, so goos-init can repair either slot from the
+// start.
+func writeBootPartition(disk *diskpkg.Disk, num int, label string, f *bootFiles) error {
+	fs, err := disk.CreateFilesystem(diskpkg.FilesystemSpec{
+		Partition:   num,
+		FSType:      filesystem.TypeFat32,
+		VolumeLabel: fatLabel(label),
+	})
+	if err != nil {
+		return fmt.Errorf("format: %w", err)
+	}
+	defer fs.Close()
+	for name, b := range map[string][]byte{
+		bundle.KernelName:    f.kernel,
+		bundle.InitrdName:    f.initrd,
+		bundle.SignatureName: f.sig,
+		bundle.ManifestName:  f.manifest,
+	} {
+		if err := writeFile(fs, "/"+name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fatLabel fits a GPT name into the 11 characters of a FAT label.
+func fatLabel(name string) string {
+	name = strings.ToUpper(name)
+	if len(name) > 11 {
+		name = name[:11]
+	}
+	return name
+}
+
+// formatSwap writes a swap header, as mkswap does, so goos-init can
+// swapon the partition without swap tools in the initramfs.
+func formatSwap(dev, label string) error {
+	waitDevice(dev)
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	const page = 4096
+	pages := size / page
+	if pages < 10 {
+		return fmt.Errorf("swap partition too small")
+	}
+	hdr := make([]byte, page)
+	le := binary.LittleEndian
+	le.PutUint32(hdr[1024:], 1) // version
+	le.PutUint32(hdr[1028:], uint32(pages-1))
+	id := uuid.New()
+	copy(hdr[1036:1052], id[:])
+	copy(hdr[1052:1068], label)
+	copy(hdr[page-10:], "SWAPSPACE2")
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
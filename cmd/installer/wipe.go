@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/vpereira/goos/internal/blkid"
+	"golang.org/x/sys/unix"
+)
+
+// Wipe modes. Every mode erases the signatures blkid finds on the disk and
+// its partitions and zeroes the first and last MiB, where partition
+// tables, RAID superblocks and ZFS labels live; discard then TRIMs the
+// whole disk and zero overwrites it.
+const (
+	wipeSignatures = "signatures"
+	wipeDiscard    = "discard"
+	wipeZero       = "zero"
+)
+
+// wipeChunk is how much is discarded or zeroed per ioctl, so progress can
+// be shown.
+const wipeChunk = 1 << 30
+
+// wipeDisk clears a disk before it is partitioned.
+func wipeDisk(disk, mode string) error {
+	for _, p := range readParts(disk, nil) {
+		if err := eraseSignatures(p.name); err != nil {
+			return err
+		}
+	}
+	if err := eraseSignatures(disk); err != nil {
+		return err
+	}
+
+	// O_EXCL fails if the kernel still has the disk in use.
+	f, err := os.OpenFile(filepath.Join("/dev", disk), os.O_RDWR|syscall.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", disk, err)
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	edge := min(int64(1<<20), size/2)
+	zero := make([]byte, edge)
+	if _, err := f.WriteAt(zero, 0); err != nil {
+		return fmt.Errorf("zero start of %s: %w", disk, err)
+	}
+	if _, err := f.WriteAt(zero, size-edge); err != nil {
+		return fmt.Errorf("zero end of %s: %w", disk, err)
+	}
+
+	switch mode {
+	case wipeDiscard:
+		if err := blockRange(f, disk, size, unix.BLKDISCARD, "Discarding"); err != nil {
+			fmt.Printf("WARN: discard %s: %v\n", disk, err)
+		}
+	case wipeZero:
+		if err := blockRange(f, disk, size, unix.BLKZEROOUT, "Zeroing"); err != nil {
+			return fmt.Errorf("zero %s: %w", disk, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	// Drop the old partitions from the kernel; this fails harmlessly when
+	// there were none.
+	_, _, _ = unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKRRPART, 0)
+	return nil
+}
+
+// eraseSignatures erases what wipefs -a would on /dev/<name>.
+func eraseSignatures(name string) error {
+	dev := filepath.Join("/dev", name)
+	sigs, err := blkid.ProbeFile(dev)
+	if err != nil {
+		return fmt.Errorf("probe %s: %w", name, err)
+	}
+	if len(sigs) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := blkid.Erase(f, sigs); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for _, s := range sigs {
+		fmt.Printf("* Erased %s signature at %#x on %s\n", s.Type, s.Offset, name)
+	}
+	return f.Sync()
+}
+
+// blockRange runs BLKDISCARD or BLKZEROOUT over the whole disk a chunk at
+// a time, printing progress every 10%.
+func blockRange(f *os.File, disk string, size int64, req uintptr, verb string) error {
+	next := 0
+	for off := int64(0); off < size; off += wipeChunk {
+		r := [2]uint64{uint64(off), uint64(min(wipeChunk, size-off))}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			return errno
+		}
+		if pct := int((off + int64(r[1])) * 100 / size); pct >= next {
+			fmt.Printf("* %s %s: %d%%\n", verb, disk, pct)
+			next = pct/10*10 + 10
+		}
+	}
+	return nil
+}
+
+func wipeLabel(mode string) string {
+	switch mode {
+	case wipeDiscard:
+		return "erase signatures and discard (TRIM)"
+	case wipeZero:
+		return "erase signatures and zero-fill"
+	}
+	return "erase signatures"
+}
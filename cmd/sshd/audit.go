@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// audit logs an audit record as "audit event=<event> key=value ...",
+// like goos-init does, to the console and the kernel log.
+func audit(event string, kv ...any) {
+	var b strings.Builder
+	b.WriteString("audit event=" + event)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"'=\\") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], v)
+	}
+	log.Print(b.String())
+	_ = os.WriteFile("/dev/kmsg", []byte(log.Prefix()+b.String()+"\n"), 0o644)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authenticator checks public keys and OpenSSH user certificates.
+type authenticator struct {
+	authorized map[string]bool
+	cas        map[string]bool
+	principals []string
+	revoked    string
+	checker    *ssh.CertChecker
+}
+
+func newAuthenticator(sc *serverConfig) (*authenticator, error) {
+	authorized, err := loadAuthorizedKeys(sc.authorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{
+		authorized: authorized,
+		principals: sc.principals,
+		revoked:    sc.revokedKeys,
+	}
+	if sc.userCAKeys != "" {
+		if a.cas, err = loadAuthorizedKeys(sc.userCAKeys); err != nil {
+			return nil, err
+		}
+	}
+	a.checker = &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return a.cas[string(auth.Marshal())]
+		},
+		// source-address is enforced by x/crypto/ssh itself.
+		SupportedCriticalOptions: []string{"force-command", "source-address"},
+	}
+	if _, err := a.revocations(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// publicKey is the ssh.ServerConfig PublicKeyCallback.
+func (a *authenticator) publicKey(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	rl, err := a.revocations()
+	if err != nil {
+		// Fail closed: a broken list must not let revoked keys back in.
+		log.Printf("revoked keys: %v", err)
+		return nil, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		if rl.revokedKey(pubKey) {
+			return nil, fmt.Errorf("revoked public key for %q", c.User())
+		}
+		if !a.authorized[string(pubKey.Marshal())] {
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		}
+		return &ssh.Permissions{
+			Extensions: map[string]string{
+				"pubkey-fp":  ssh.FingerprintSHA256(pubKey),
+				"permit-pty": "",
+			},
+		}, nil
+	}
+	return a.certificate(c, cert, rl)
+}
+
+func (a *authenticator) certificate(c ssh.ConnMetadata, cert *ssh.Certificate, rl *revocationList) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	if !a.checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, fmt.Errorf("certificate %q signed by an untrusted CA", cert.KeyId)
+	}
+	if rl.revokedCert(cert) {
+		return nil, fmt.Errorf("certificate %q serial %d revoked", cert.KeyId, cert.Serial)
+	}
+	// Unlike x/crypto/ssh, and like OpenSSH, a certificate without
+	// principals is not valid for anyone.
+	principal := c.User()
+	if len(a.principals) > 0 {
+		principal = ""
+		for _, p := range cert.ValidPrincipals {
+			if slices.Contains(a.principals, p) {
+				principal = p
+				break
+			}
+		}
+	}
+	if principal == "" || !slices.Contains(cert.ValidPrincipals, principal) {
+		return nil, fmt.Errorf("certificate %q has no authorized principal for %q", cert.KeyId, c.User())
+	}
+	if err := a.checker.CheckCert(principal, cert); err != nil {
+		return nil, fmt.Errorf("certificate %q: %w", cert.KeyId, err)
+	}
+	perms := &ssh.Permissions{
+		CriticalOptions: cert.CriticalOptions,
+		Extensions: map[string]string{
+			"pubkey-fp":   ssh.FingerprintSHA256(cert.Key),
+			"cert-id":     cert.KeyId,
+			"cert-serial": strconv.FormatUint(cert.Serial, 10),
+			"principal":   principal,
+		},
+	}
+	for k, v := range cert.Extensions {
+		perms.Extensions[k] = v
+	}
+	return perms, nil
+}
+
+func (a *authenticator) revocations() (*revocationList, error) {
+	if a.revoked == "" {
+		return &revocationList{}, nil
+	}
+	return loadRevocationList(a.revoked)
+}
+
+// revocationList is the text form of an OpenSSH KRL, as accepted by
+// "ssh-keygen -k": lines of "serial: N[-M]", "id: KEYID",
+// "key: PUBKEY", "sha256: FINGERPRINT" or a bare public key. Serials and
+// ids apply to certificates from any trusted CA; keys and fingerprints
+// revoke plain keys, certificate keys and CAs alike.
+type revocationList struct {
+	keys    map[string]bool
+	fps     map[string]bool
+	ids     map[string]bool
+	serials [][2]uint64
+}
+
+func loadRevocationList(path string) (*revocationList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &revocationList{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	rl := &revocationList{keys: map[string]bool{}, fps: map[string]bool{}, ids: map[string]bool{}}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, v, ok := strings.Cut(line, ":")
+		v = strings.TrimSpace(v)
+		if !ok || strings.ContainsAny(kind, " \t") {
+			kind, v = "key", line
+		}
+		switch kind {
+		case "serial":
+			lo, hi, isRange := strings.Cut(v, "-")
+			if !isRange {
+				hi = lo
+			}
+			l, err1 := strconv.ParseUint(lo, 0, 64)
+			h, err2 := strconv.ParseUint(hi, 0, 64)
+			if err1 != nil || err2 != nil || h < l {
+				return nil, fmt.Errorf("%s:%d: bad serial %q", path, n, v)
+			}
+			rl.serials = append(rl.serials, [2]uint64{l, h})
+		case "id":
+			rl.ids[v] = true
+		case "key":
+			k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			rl.keys[string(k.Marshal())] = true
+		case "sha256":
+			rl.fps["SHA256:"+strings.TrimPrefix(v, "SHA256:")] = true
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown entry %q", path, n, kind)
+		}
+	}
+	return rl, sc.Err()
+}
+
+func (rl *revocationList) revokedKey(k ssh.PublicKey) bool {
+	return rl.keys[string(k.Marshal())] || rl.fps[ssh.FingerprintSHA256(k)]
+}
+
+func (rl *revocationList) revokedCert(cert *ssh.Certificate) bool {
+	if rl.revokedKey(cert.Key) || rl.revokedKey(cert.SignatureKey) || rl.ids[cert.KeyId] {
+		return true
+	}
+	for _, r := range rl.serials {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthorizedKeys reads an authorized_keys file into a lookup set.
+func loadAuthorizedKeys(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for len(b) > 0 {
+		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			// ParseAuthorizedKey fails on trailing blank lines too.
+			if strings.TrimSpace(string(b)) == "" {
+				break
+			}
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		set[string(pubKey.Marshal())] = true
+		b = rest
+	}
+	return set, nil
+}
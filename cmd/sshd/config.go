@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpereira/goos/internal/config"
+)
+
+// serverConfig is the goos-sshd config file, written by goos-init from
+// the ssh_* installer settings.
+type serverConfig struct {
+	listen         []string
+	port           string
+	hostKeys       []string
+	authorizedKeys string
+	// userCAKeys trusts user certificates signed by these CAs, for
+	// principals or, if unset, the login name.
+	userCAKeys string
+	principals []string
+	// revokedKeys is reread on every login.
+	revokedKeys string
+	// passwordHash enables root password auth when set.
+	passwordHash string
+	// maxAuthFailures failed login attempts from one address within
+	// banTime ban it for banTime.
+	maxAuthFailures int
+	banTime         time.Duration
+	// maxStartups caps connections that have not logged in yet, overall
+	// and per address.
+	maxStartups      int
+	maxStartupsPerIP int
+	// maxSessions caps logged-in connections, overall and per address.
+	maxSessions      int
+	maxSessionsPerIP int
+	// acl restricts matching keys and principals to the goos command.
+	acl []aclEntry
+	// fileRoot and readOnly confine SFTP and scp.
+	fileRoot string
+	readOnly []string
+}
+
+// aclEntry grants perms to who: "principal:<name>" for certificates or a
+// "SHA256:..." key fingerprint.
+type aclEntry struct {
+	who   string
+	perms []string
+}
+
+func loadServerConfig(path string) (*serverConfig, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &serverConfig{
+		listen:         cfg.List("listen"),
+		port:           cfg.Get("port"),
+		hostKeys:       cfg.List("host_keys"),
+		authorizedKeys: cfg.Get("authorized_keys"),
+		userCAKeys:     cfg.Get("trusted_user_ca_keys"),
+		principals:     cfg.List("authorized_principals"),
+		revokedKeys:    cfg.Get("revoked_keys"),
+		passwordHash:   cfg.Get("password_hash"),
+		fileRoot:       cfg.Get("file_root"),
+		readOnly:       cfg.List("readonly_paths"),
+	}
+	if len(sc.listen) == 0 {
+		sc.listen = []string{"0.0.0.0"}
+	}
+	if sc.port == "" {
+		sc.port = "2222"
+	}
+	if len(sc.hostKeys) == 0 {
+		return nil, fmt.Errorf("%s: no host_keys", path)
+	}
+	ints := []struct {
+		key string
+		v   *int
+		def int
+	}{
+		{"max_auth_failures", &sc.maxAuthFailures, 10},
+		{"max_startups", &sc.maxStartups, 10},
+		{"max_startups_per_ip", &sc.maxStartupsPerIP, 3},
+		{"max_sessions", &sc.maxSessions, 10},
+		{"max_sessions_per_ip", &sc.maxSessionsPerIP, 4},
+	}
+	for _, i := range ints {
+		*i.v = i.def
+		if v := cfg.Get(i.key); v != "" {
+			if *i.v, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, i.key, err)
+			}
+		}
+	}
+	sc.banTime = 10 * time.Minute
+	if v := cfg.Get("ban_time"); v != "" {
+		if sc.banTime, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("%s: ban_time: %w", path, err)
+		}
+	}
+	for _, v := range cfg.Prefixed("acl") {
+		who, perms, ok := strings.Cut(strings.TrimSpace(v), " ")
+		if !ok {
+			return nil, fmt.Errorf("%s: acl %q: want \"<who> <perm>,...\"", path, v)
+		}
+		list := config.SplitList(perms)
+		if len(list) == 0 {
+			return nil, fmt.Errorf("%s: acl %q: no permissions", path, v)
+		}
+		sc.acl = append(sc.acl, aclEntry{who: who, perms: list})
+	}
+	if sc.fileRoot == "" {
+		sc.fileRoot = "/"
+	}
+	if sc.authorizedKeys == "" {
+		sc.authorizedKeys = "/run/goos/authorized_keys"
+	}
+	return sc, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinks bounds symlink resolution like the kernel's ELOOP limit.
+const maxSymlinks = 40
+
+// fileSystem is the view of the node that SFTP and scp clients get: paths
+// are resolved under root as if it were a chroot, and nothing at or below
+// a read-only path may be modified. The shell is not confined.
+type fileSystem struct {
+	root     string
+	readOnly []string
+}
+
+func newFileSystem(root string, readOnly []string) *fileSystem {
+	fsys := &fileSystem{root: filepath.Clean(root)}
+	for _, p := range readOnly {
+		fsys.readOnly = append(fsys.readOnly, path.Clean("/"+p))
+	}
+	return fsys
+}
+
+// resolve maps a client path to a host path under root. Symlinks are
+// followed inside the root, absolute targets being relative to it; the
+// last component is only followed if follow is set. It also returns the
+// resolved client-side path.
+func (fsys *fileSystem) resolve(name string, follow bool) (string, string, error) {
+	todo := strings.Split(path.Clean("/"+name), "/")
+	cur := "/"
+	links := 0
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, c)
+		if len(todo) == 0 && !follow {
+			cur = next
+			break
+		}
+		host := filepath.Join(fsys.root, next)
+		fi, err := os.Lstat(host)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", "", &fs.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(host)
+		if err != nil {
+			return "", "", err
+		}
+		if path.IsAbs(target) {
+			cur = "/"
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(fsys.root, cur), cur, nil
+}
+
+// path resolves name for reading.
+func (fsys *fileSystem) path(name string, follow bool) (string, error) {
+	host, _, err := fsys.resolve(name, follow)
+	return host, err
+}
+
+// writable resolves name for a modifying operation, refusing read-only
+// paths as well as their parents, so they cannot be renamed or removed
+// from above.
+func (fsys *fileSystem) writable(op, name string, follow bool) (string, error) {
+	host, p, err := fsys.resolve(name, follow)
+	if err != nil {
+		return "", err
+	}
+	for _, ro := range fsys.readOnly {
+		if within(p, ro) || within(ro, p) {
+			return "", &fs.PathError{Op: op, Path: name, Err: syscall.EROFS}
+		}
+	}
+	return host, nil
+}
+
+// within reports whether p is dir or below it.
+func within(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+func (fsys *fileSystem) open(name string) (*os.File, error) {
+	host, err := fsys.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(host)
+}
+
+func (fsys *fileSystem) openFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return fsys.open(name)
+	}
+	host, err := fsys.writable("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(host, flag, perm)
+}
+
+func (fsys *fileSystem) stat(name string) (fs.FileInfo, error) {
+	host, err := fsys.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(host)
+}
+
+func (fsys *fileSystem) lstat(name string) (fs.FileInfo, error) {
+	host, err := fsys.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(host)
+}
+
+func (fsys *fileSystem) readDir(name string) ([]fs.FileInfo, error) {
+	f, err := fsys.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+func (fsys *fileSystem) readlink(name string) (string, error) {
+	host, err := fsys.path(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(host)
+}
+
+func (fsys *fileSystem) mkdir(name string, perm fs.FileMode) error {
+	host, err := fsys.writable("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(host, perm)
+}
+
+func (fsys *fileSystem) remove(name string) error {
+	host, err := fsys.writable("remove", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(host)
+}
+
+func (fsys *fileSystem) rename(from, to string) error {
+	src, err := fsys.writable("rename", from, false)
+	if err != nil {
+		return err
+	}
+	dst, err := fsys.writable("rename", to, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (fsys *fileSystem) symlink(target, name string) error {
+	host, err := fsys.writable("symlink", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, host)
+}
+
+func (fsys *fileSystem) link(from, to string) error {
+	// Both names end up sharing one inode, so both must be writable.
+	src, err := fsys.writable("link", from, false)
+	if err != nil {
+		return err
+	}
+	dst, err := fsys.writable("link", to, false)
+	if err != nil {
+		return err
+	}
+	return os.Link(src, dst)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// guard throttles and bans source addresses that fail to log in. Like
+// OpenSSH's MaxStartups it caps connections still in the handshake,
+// overall and per address, separately from the cap on logged-in sessions,
+// so unauthenticated clients cannot lock out logged-in users or the other
+// way round.
+type guard struct {
+	maxFailures      int
+	banTime          time.Duration
+	maxStartups      int
+	maxStartupsPerIP int
+	maxSessions      int
+	maxPerIP         int
+
+	mu       sync.Mutex
+	failures map[string]*failures
+	startups slots
+	sessions slots
+}
+
+type failures struct {
+	count  int
+	last   time.Time
+	banned time.Time
+}
+
+// slots counts connections overall and per address.
+type slots struct {
+	total int
+	perIP map[string]int
+}
+
+// full returns the audit reason when no slot is left for ip, or "".
+func (s *slots) full(ip, name string, max, maxPerIP int) string {
+	switch {
+	case max > 0 && s.total >= max:
+		return "max-" + name
+	case maxPerIP > 0 && s.perIP[ip] >= maxPerIP:
+		return "max-" + name + "-per-ip"
+	}
+	return ""
+}
+
+func (s *slots) take(ip string) {
+	s.total++
+	s.perIP[ip]++
+}
+
+func (s *slots) free(ip string) {
+	s.total--
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+func newGuard(sc *serverConfig) *guard {
+	return &guard{
+		maxFailures:      sc.maxAuthFailures,
+		banTime:          sc.banTime,
+		maxStartups:      sc.maxStartups,
+		maxStartupsPerIP: sc.maxStartupsPerIP,
+		maxSessions:      sc.maxSessions,
+		maxPerIP:         sc.maxSessionsPerIP,
+		failures:         map[string]*failures{},
+		startups:         slots{perIP: map[string]int{}},
+		sessions:         slots{perIP: map[string]int{}},
+	}
+}
+
+// admit reserves a handshake slot for ip until handshakeDone. It returns
+// why the connection is refused, or "" and how long to stall the
+// handshake when ip has been failing recently.
+func (g *guard) admit(ip string) (reason string, delay time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	f := g.failures[ip]
+	if f != nil && now.Sub(f.last) > g.banTime {
+		delete(g.failures, ip)
+		f = nil
+	}
+	if f != nil && now.Before(f.banned) {
+		return "banned", 0
+	}
+	if full := g.startups.full(ip, "startups", g.maxStartups, g.maxStartupsPerIP); full != "" {
+		return full, 0
+	}
+	g.startups.take(ip)
+	if f != nil {
+		delay = min(time.Duration(f.count)*time.Second, 10*time.Second)
+	}
+	return "", delay
+}
+
+// handshakeDone frees the handshake slot taken by admit.
+func (g *guard) handshakeDone(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.startups.free(ip)
+}
+
+// open reserves a session slot for a logged-in client until release. It
+// returns why the session is refused, or "".
+func (g *guard) open(ip string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if full := g.sessions.full(ip, "sessions", g.maxSessions, g.maxPerIP); full != "" {
+		return full
+	}
+	g.sessions.take(ip)
+	return ""
+}
+
+// release frees the session slot taken by open.
+func (g *guard) release(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sessions.free(ip)
+}
+
+// fail records a failed login attempt from ip and reports whether it is
+// now banned, and until when.
+func (g *guard) fail(ip string) (bool, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := g.failures[ip]
+	if f == nil {
+		f = &failures{}
+		g.failures[ip] = f
+	}
+	f.count++
+	f.last = time.Now()
+	if g.maxFailures > 0 && f.count >= g.maxFailures {
+		f.banned = f.last.Add(g.banTime)
+		return true, f.banned
+	}
+	return false, time.Time{}
+}
+
+// succeed forgets earlier failures of ip.
+func (g *guard) succeed(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, ip)
+}
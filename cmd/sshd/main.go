@@ -0,0 +1,253 @@
+// goos-sshd is the SSH server started by goos-init. It takes over from
+// u-root's sshd so a node can serve several host keys and listeners and
+// be configured from the installer config.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vpereira/goos/internal/passwd"
+	"golang.org/x/crypto/ssh"
+)
+
+// shell is the u-root default shell (gosh via /bin/sh).
+const shell = "/bin/sh"
+
+var (
+	debug      = flag.Bool("d", false, "Enable debug prints")
+	configPath = flag.String("config", "/run/goos/sshd.conf", "Path of the goos-sshd config written by goos-init")
+	dprintf    = func(string, ...any) {}
+)
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("goos-sshd: ")
+	if *debug {
+		dprintf = log.Printf
+	}
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	sc, err := loadServerConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	auth, err := newAuthenticator(sc)
+	if err != nil {
+		return err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: auth.publicKey,
+	}
+	if sc.passwordHash != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "root" || !passwd.Verify(sc.passwordHash, string(pass)) {
+				time.Sleep(2 * time.Second)
+				return nil, fmt.Errorf("password rejected for %q", c.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"auth": "password", "permit-pty": ""}}, nil
+		}
+	}
+	for _, path := range sc.hostKeys {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		config.AddHostKey(signer)
+		dprintf("host key %s %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+
+	var listeners []net.Listener
+	for _, addr := range sc.listen {
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, sc.port))
+		if err != nil {
+			return err
+		}
+		log.Printf("listening on %s", l.Addr())
+		listeners = append(listeners, l)
+	}
+	srv := &server{
+		config: config,
+		fsys:   newFileSystem(sc.fileRoot, sc.readOnly),
+		guard:  newGuard(sc),
+		acl:    sc.acl,
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- srv.serve(l)
+		}(l)
+	}
+	return <-errc
+}
+
+// loginGraceTime bounds the handshake, so stalled clients cannot hold
+// handshake slots.
+const loginGraceTime = 30 * time.Second
+
+type server struct {
+	config *ssh.ServerConfig
+	fsys   *fileSystem
+	guard  *guard
+	acl    []aclEntry
+}
+
+// allowed returns the goos permissions of a restricted client, or nil
+// when no ACL entry names its key or certificate principal. A matched
+// client always gets a non-nil slice, so one whose entries grant nothing
+// is denied everything rather than unrestricted.
+func (s *server) allowed(ext map[string]string) []string {
+	perms, matched := []string{}, false
+	for _, e := range s.acl {
+		if (ext["pubkey-fp"] != "" && e.who == ext["pubkey-fp"]) ||
+			(ext["principal"] != "" && e.who == "principal:"+ext["principal"]) {
+			perms = append(perms, e.perms...)
+			matched = true
+		}
+	}
+	if !matched {
+		return nil
+	}
+	return perms
+}
+
+func (s *server) serve(l net.Listener) error {
+	for {
+		nConn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handleConn(nConn)
+	}
+}
+
+func (s *server) handleConn(nConn net.Conn) {
+	defer nConn.Close()
+	ip := remoteIP(nConn.RemoteAddr())
+	reason, delay := s.guard.admit(ip)
+	if reason != "" {
+		audit("reject", "ip", ip, "reason", reason)
+		return
+	}
+	time.Sleep(delay)
+
+	// Every rejected key, certificate or password counts towards a ban, and
+	// the connection is dropped as soon as the address is banned.
+	config := *s.config
+	config.AuthLogCallback = func(_ ssh.ConnMetadata, method string, err error) {
+		if err == nil || method == "none" {
+			return
+		}
+		audit("auth-failed", "ip", ip, "method", method, "error", err)
+		if banned, until := s.guard.fail(ip); banned {
+			audit("ban", "ip", ip, "until", until.UTC().Format(time.RFC3339))
+			nConn.Close()
+		}
+	}
+	nConn.SetDeadline(time.Now().Add(loginGraceTime))
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, &config)
+	s.guard.handshakeDone(ip)
+	if err != nil {
+		dprintf("%v: handshake: %v", nConn.RemoteAddr(), err)
+		return
+	}
+	nConn.SetDeadline(time.Time{})
+	s.guard.succeed(ip)
+	if reason := s.guard.open(ip); reason != "" {
+		audit("reject", "ip", ip, "user", conn.User(), "reason", reason)
+		return
+	}
+	defer s.guard.release(ip)
+
+	c := &client{conn: conn, ip: ip, fsys: s.fsys, start: time.Now()}
+	ext := conn.Permissions.Extensions
+	c.fp = ext["pubkey-fp"]
+	c.allowed = s.allowed(ext)
+	kv := []any{"ip", ip, "user", conn.User()}
+	switch {
+	case ext["cert-id"] != "":
+		kv = append(kv, "auth", "certificate", "fp", c.fp, "cert_id", ext["cert-id"], "serial", ext["cert-serial"])
+	case c.fp != "":
+		kv = append(kv, "auth", "publickey", "fp", c.fp)
+	default:
+		kv = append(kv, "auth", ext["auth"])
+	}
+	audit("login", kv...)
+	defer func() {
+		audit("logout", "ip", ip, "fp", c.fp, "duration", time.Since(c.start).Round(time.Millisecond), "commands", c.commands.Load())
+	}()
+
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("accept channel: %v", err)
+			continue
+		}
+		go serveSession(channel, requests, c)
+	}
+}
+
+// client is an authenticated connection.
+type client struct {
+	conn *ssh.ServerConn
+	ip   string
+	fp   string
+	fsys *fileSystem
+	// allowed is non-nil for clients restricted to the goos command.
+	allowed  []string
+	start    time.Time
+	commands atomic.Int64
+}
+
+// environ describes the client to the commands it runs.
+func (c *client) environ() []string {
+	ext := c.conn.Permissions.Extensions
+	env := []string{
+		"GOOS_SSH_USER=" + c.conn.User(),
+		"GOOS_SSH_CLIENT_IP=" + c.ip,
+		"GOOS_SSH_KEY_FP=" + c.fp,
+	}
+	if p := ext["principal"]; p != "" {
+		env = append(env, "GOOS_SSH_PRINCIPAL="+p, "GOOS_SSH_CERT_ID="+ext["cert-id"])
+	}
+	if c.allowed != nil {
+		env = append(env, "GOOS_SSH_ALLOWED="+strings.Join(c.allowed, ","))
+	}
+	return env
+}
+
+// audit records a command run by the client.
+func (c *client) audit(command string) {
+	c.commands.Add(1)
+	audit("command", "ip", c.ip, "fp", c.fp, "command", command)
+}
+
+func remoteIP(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return addr.String()
+}
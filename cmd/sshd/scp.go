@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpCmd is a parsed remote "scp -t" (sink) or "scp -f" (source) command,
+// as run by "scp -O" and older clients. Newer clients use SFTP instead.
+type scpCmd struct {
+	sink, source bool
+	recursive    bool
+	preserve     bool
+	targetDir    bool
+	paths        []string
+}
+
+// parseSCP reports whether command is a remote scp invocation we serve
+// ourselves instead of handing it to the shell.
+func parseSCP(command string) (*scpCmd, bool) {
+	args := splitWords(command)
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, false
+	}
+	c := &scpCmd{}
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		a := args[0]
+		args = args[1:]
+		if a == "--" {
+			break
+		}
+		for _, f := range a[1:] {
+			switch f {
+			case 't':
+				c.sink = true
+			case 'f':
+				c.source = true
+			case 'r':
+				c.recursive = true
+			case 'p':
+				c.preserve = true
+			case 'd':
+				c.targetDir = true
+			case 'v', 'q':
+			default:
+				return nil, false
+			}
+		}
+	}
+	c.paths = args
+	if c.sink == c.source || len(c.paths) == 0 || (c.sink && len(c.paths) != 1) {
+		return nil, false
+	}
+	return c, true
+}
+
+// splitWords splits a command line the way a POSIX shell would for the
+// quoting scp clients use: single and double quotes and backslashes.
+func splitWords(s string) []string {
+	var words []string
+	var w strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			w.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				w.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words
+}
+
+// scpConn speaks the scp wire protocol on an SSH channel.
+type scpConn struct {
+	r    *bufio.Reader
+	w    io.Writer
+	fsys *fileSystem
+	// failed is set once any error was reported to the client.
+	failed bool
+}
+
+func serveSCP(channel ssh.Channel, fsys *fileSystem, cmd *scpCmd) {
+	defer channel.Close()
+	c := &scpConn{r: bufio.NewReader(channel), w: channel, fsys: fsys}
+	var err error
+	if cmd.sink {
+		err = c.sink(cmd)
+	} else {
+		err = c.source(cmd)
+	}
+	code := 0
+	if err != nil {
+		log.Printf("scp: %v", err)
+		code = 1
+	} else if c.failed {
+		code = 1
+	}
+	sendExitStatus(channel, code)
+}
+
+func (c *scpConn) ack() error {
+	_, err := c.w.Write([]byte{0})
+	return err
+}
+
+// fail reports a non-fatal error; the client moves on to the next file.
+func (c *scpConn) fail(err error) error {
+	c.failed = true
+	_, werr := fmt.Fprintf(c.w, "\x01scp: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	return werr
+}
+
+// readAck reads the client's response to the last message.
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// sinkDir is a directory being received, with the times to set on it
+// once it is complete.
+type sinkDir struct {
+	path         string
+	atime, mtime time.Time
+	times        bool
+}
+
+// sink receives files into cmd.paths[0].
+func (c *scpConn) sink(cmd *scpCmd) error {
+	target := cmd.paths[0]
+	fi, err := c.fsys.stat(target)
+	isDir := err == nil && fi.IsDir()
+	if cmd.targetDir && !isDir {
+		c.fail(fmt.Errorf("%s: not a directory", target))
+		return nil
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	var dirs []sinkDir
+	var atime, mtime time.Time
+	times := false
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case '\x01', '\x02':
+			// The client reports its own errors, e.g. unreadable files.
+			c.failed = true
+			if line[0] == '\x02' {
+				return errors.New(line[1:])
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unexpected E")
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if d.times {
+				if host, err := c.fsys.writable("chtimes", d.path, true); err == nil {
+					_ = os.Chtimes(host, d.atime, d.mtime)
+				}
+			}
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'T':
+			var ms, mus, as, aus int64
+			if _, err := fmt.Sscanf(line[1:], "%d %d %d %d", &ms, &mus, &as, &aus); err != nil {
+				return fmt.Errorf("bad times %q", line)
+			}
+			mtime, atime, times = time.Unix(ms, mus*1000), time.Unix(as, aus*1000), true
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("unexpected %q", line)
+		}
+
+		f := strings.SplitN(line[1:], " ", 3)
+		if len(f) != 3 {
+			return fmt.Errorf("bad header %q", line)
+		}
+		mode, err1 := strconv.ParseUint(f[0], 8, 32)
+		size, err2 := strconv.ParseInt(f[1], 10, 64)
+		name := f[2]
+		if err1 != nil || err2 != nil || size < 0 || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("bad header %q", line)
+		}
+		dst := target
+		switch {
+		case len(dirs) > 0:
+			dst = path.Join(dirs[len(dirs)-1].path, name)
+		case isDir:
+			dst = path.Join(target, name)
+		}
+		perm := fs.FileMode(mode) & fs.ModePerm
+
+		if line[0] == 'D' {
+			if !cmd.recursive {
+				return errors.New("received directory without -r")
+			}
+			if err := c.sinkMkdir(dst, perm, cmd.preserve); err != nil {
+				c.fail(err)
+				times = false
+				continue
+			}
+			dirs = append(dirs, sinkDir{path: dst, atime: atime, mtime: mtime, times: times})
+			times = false
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := c.fsys.openFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			c.fail(err)
+			times = false
+			continue
+		}
+		if err := c.ack(); err != nil {
+			file.Close()
+			return err
+		}
+		data := &io.LimitedReader{R: c.r, N: size}
+		_, werr := io.Copy(file, data)
+		if werr == nil && data.N > 0 {
+			file.Close()
+			return io.ErrUnexpectedEOF
+		}
+		if werr != nil {
+			// Drain the rest of the file to stay in sync with the client.
+			if _, err := io.Copy(io.Discard, data); err != nil || data.N > 0 {
+				file.Close()
+				return werr
+			}
+		}
+		if werr == nil && cmd.preserve {
+			werr = file.Chmod(perm)
+		}
+		if cerr := file.Close(); werr == nil {
+			werr = cerr
+		}
+		if werr == nil && times {
+			if host, err := c.fsys.path(dst, true); err == nil {
+				werr = os.Chtimes(host, atime, mtime)
+			}
+		}
+		times = false
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		if werr != nil {
+			c.fail(werr)
+			continue
+		}
+		if err := c.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *scpConn) sinkMkdir(dir string, perm fs.FileMode, preserve bool) error {
+	if fi, err := c.fsys.stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", dir)
+		}
+		if !preserve {
+			return nil
+		}
+		host, err := c.fsys.writable("chmod", dir, true)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(host, perm)
+	}
+	return c.fsys.mkdir(dir, perm|0o700)
+}
+
+// source sends the files named by cmd.paths, which may be glob patterns.
+func (c *scpConn) source(cmd *scpCmd) error {
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	for _, p := range cmd.paths {
+		names := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			matches, err := fs.Glob(globFS{c.fsys}, strings.TrimPrefix(path.Clean("/"+p), "/"))
+			if err != nil || len(matches) == 0 {
+				if err := c.fail(fmt.Errorf("%s: no match", p)); err != nil {
+					return err
+				}
+				continue
+			}
+			names = matches
+		}
+		for _, name := range names {
+			if err := c.send(name, cmd, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send sends a file or, with -r, a directory tree. Paths the client named
+// are followed if they are symlinks; inside a tree, symlinks to files are
+// sent as files and other symlinks are skipped, so a link back up the tree
+// cannot make the copy recurse forever.
+func (c *scpConn) send(name string, cmd *scpCmd, follow bool) error {
+	stat := c.fsys.lstat
+	if follow {
+		stat = c.fsys.stat
+	}
+	fi, err := stat(name)
+	if err != nil {
+		return c.fail(err)
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if fi, err = c.fsys.stat(name); err != nil || fi.IsDir() {
+			dprintf("scp: %s: skipping symlink", name)
+			return nil
+		}
+	}
+	if cmd.preserve {
+		atime := fi.ModTime()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			atime = time.Unix(st.Atim.Unix())
+		}
+		if _, err := fmt.Fprintf(c.w, "T%d 0 %d 0\n", fi.ModTime().Unix(), atime.Unix()); err != nil {
+			return err
+		}
+		if err := c.readAck(); err != nil {
+			return err
+		}
+	}
+	base := path.Base(path.Clean("/" + name))
+	if fi.IsDir() {
+		if !cmd.recursive {
+			return c.fail(fmt.Errorf("%s: not a regular file", name))
+		}
+		entries, err := c.fsys.readDir(name)
+		if err != nil {
+			return c.fail(err)
+		}
+		if _, err := fmt.Fprintf(c.w, "D%04o 0 %s\n", fi.Mode().Perm(), base); err != nil {
+			return err
+		}
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := c.send(path.Join(name, e.Name()), cmd, false); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(c.w, "E\n"); err != nil {
+			return err
+		}
+		return c.readAck()
+	}
+	if !fi.Mode().IsRegular() {
+		return c.fail(fmt.Errorf("%s: not a regular file", name))
+	}
+	f, err := c.fsys.open(name)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(c.w, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), base); err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	n, rerr := io.CopyN(c.w, f, fi.Size())
+	if rerr != nil {
+		// The header promised fi.Size() bytes; pad and report the error.
+		if _, err := io.CopyN(c.w, zeroReader{}, fi.Size()-n); err != nil {
+			return err
+		}
+		if err := c.fail(rerr); err != nil {
+			return err
+		}
+	} else if err := c.ack(); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// globFS adapts a fileSystem to fs.FS for fs.Glob.
+type globFS struct {
+	fsys *fileSystem
+}
+
+func (g globFS) Open(name string) (fs.File, error) {
+	f, err := g.fsys.open("/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
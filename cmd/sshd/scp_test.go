@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  scp  -t  /tmp ", []string{"scp", "-t", "/tmp"}},
+		{`scp -f 'a b' "c d"`, []string{"scp", "-f", "a b", "c d"}},
+		{`scp -f a\ b`, []string{"scp", "-f", "a b"}},
+		{`scp -f 'it'\''s'`, []string{"scp", "-f", "it's"}},
+		{`scp -f "say \"hi\""`, []string{"scp", "-f", `say "hi"`}},
+		{`scp -f 'a\b'`, []string{"scp", "-f", `a\b`}},
+		{`scp -t ''`, []string{"scp", "-t", ""}},
+		{"scp\t-t\n/x", []string{"scp", "-t", "/x"}},
+	} {
+		if got := splitWords(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSCP(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want *scpCmd
+	}{
+		{"scp -t /tmp", &scpCmd{sink: true, paths: []string{"/tmp"}}},
+		{"/usr/bin/scp -prd -t -- /tmp", &scpCmd{sink: true, recursive: true, preserve: true, targetDir: true, paths: []string{"/tmp"}}},
+		{"scp -v -f 'a b' c*", &scpCmd{source: true, paths: []string{"a b", "c*"}}},
+		{"scp -f -- -x", &scpCmd{source: true, paths: []string{"-x"}}},
+		{"scp -t", nil},
+		{"scp -t a b", nil},
+		{"scp -t -f a", nil},
+		{"scp a", nil},
+		{"scp -x -t a", nil},
+		{"sftp -t a", nil},
+		{"", nil},
+	} {
+		got, ok := parseSCP(tt.in)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSCP(%q) = %+v, %v, want %+v", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func TestSCPRoundTrip(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, body := range map[string]string{
+		"tree/one":       "first file\n",
+		"tree/sub/two":   "second file\n",
+		"tree/sub/empty": "",
+	} {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link to a file is sent as the file; a link back up the tree is
+	// skipped rather than followed forever.
+	if err := os.Symlink("one", filepath.Join(src, "tree/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(src, "tree/sub/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	// source writes to sink and sink acks back, as over an SSH channel.
+	toSink, fromSource := io.Pipe()
+	toSource, fromSink := io.Pipe()
+	source := &scpConn{r: bufio.NewReader(toSource), w: fromSource, fsys: newFileSystem(src, nil)}
+	sink := &scpConn{r: bufio.NewReader(toSink), w: fromSink, fsys: newFileSystem(dst, nil)}
+	done := make(chan error, 1)
+	go func() {
+		err := sink.sink(&scpCmd{sink: true, recursive: true, preserve: true, targetDir: true, paths: []string{"/"}})
+		fromSink.Close()
+		done <- err
+	}()
+	err := source.source(&scpCmd{source: true, recursive: true, preserve: true, paths: []string{"/tree"}})
+	fromSource.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if source.failed || sink.failed {
+		t.Fatalf("failed: source %v, sink %v", source.failed, sink.failed)
+	}
+
+	for name, body := range map[string]string{
+		"tree/one":       "first file\n",
+		"tree/link":      "first file\n",
+		"tree/sub/two":   "second file\n",
+		"tree/sub/empty": "",
+	} {
+		p := filepath.Join(dst, name)
+		b, err := os.ReadFile(p)
+		if err != nil || string(b) != body {
+			t.Errorf("%s = %q, %v; want %q", name, b, err, body)
+			continue
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0o640 {
+			t.Errorf("%s: mode %v", name, fi.Mode())
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "tree/sub/loop")); !os.IsNotExist(err) {
+		t.Errorf("symlinked directory was copied: %v", err)
+	}
+}
+
+func TestSCPSourceMissing(t *testing.T) {
+	toSource, fromSink := io.Pipe()
+	var out bytes.Buffer
+	c := &scpConn{r: bufio.NewReader(toSource), w: &out, fsys: newFileSystem(t.TempDir(), nil)}
+	go func() {
+		fromSink.Write([]byte{0})
+		fromSink.Close()
+	}()
+	if err := c.source(&scpCmd{source: true, paths: []string{"/nope", "/x*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.failed {
+		t.Error("missing files did not fail the copy")
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "\x01scp: ") || !strings.HasSuffix(lines[0], "/nope: no such file or directory") ||
+		lines[1] != "\x01scp: /x*: no match" {
+		t.Errorf("source wrote %q", out.String())
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// Payloads of the session requests we handle (RFC 4254 section 6).
+type (
+	ptyReq struct {
+		Term   string
+		Cols   uint32
+		Rows   uint32
+		Width  uint32
+		Height uint32
+		Modes  string
+	}
+	windowChangeReq struct {
+		Cols   uint32
+		Rows   uint32
+		Width  uint32
+		Height uint32
+	}
+	execReq struct {
+		Command string
+	}
+	subsystemReq struct {
+		Name string
+	}
+	exitStatusReq struct {
+		ExitStatus uint32
+	}
+)
+
+// internalSFTP names the built-in SFTP server, as in OpenSSH.
+const internalSFTP = "internal-sftp"
+
+// session is one "session" channel of an authenticated connection.
+type session struct {
+	channel ssh.Channel
+	client  *client
+	pty     *pty
+	env     []string
+}
+
+// serveSession serves the requests of one "session" channel.
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request, c *client) {
+	s := &session{channel: channel, client: c, env: append(os.Environ(), c.environ()...)}
+	perms := c.conn.Permissions
+	for req := range requests {
+		dprintf("request %s", req.Type)
+		switch req.Type {
+		case "pty-req":
+			r := &ptyReq{}
+			if err := ssh.Unmarshal(req.Payload, r); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if _, ok := perms.Extensions["permit-pty"]; !ok {
+				req.Reply(false, nil)
+				continue
+			}
+			var err error
+			if s.pty, err = newPTY(r.Cols, r.Rows); err != nil {
+				log.Printf("pty: %v", err)
+				req.Reply(false, nil)
+				continue
+			}
+			s.env = append(s.env, "TERM="+r.Term)
+			req.Reply(true, nil)
+		case "window-change":
+			r := &windowChangeReq{}
+			if s.pty != nil && ssh.Unmarshal(req.Payload, r) == nil {
+				_ = s.pty.resize(r.Cols, r.Rows)
+			}
+		case "env":
+			req.Reply(true, nil)
+		case "shell":
+			req.Reply(true, nil)
+			s.start("")
+		case "exec":
+			r := &execReq{}
+			if err := ssh.Unmarshal(req.Payload, r); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			s.start(r.Command)
+		case "subsystem":
+			r := &subsystemReq{}
+			if err := ssh.Unmarshal(req.Payload, r); err != nil || r.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			s.start(internalSFTP)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// start runs command in the background: "" is the shell, internal-sftp
+// the SFTP server and scp commands are served directly. A certificate's
+// force-command replaces whatever the client asked for.
+func (s *session) start(command string) {
+	forced, isForced := s.client.conn.Permissions.CriticalOptions["force-command"]
+	if isForced {
+		if command != "" {
+			s.env = append(s.env, "SSH_ORIGINAL_COMMAND="+command)
+		}
+		command = forced
+	}
+	if command == "" {
+		s.client.audit("shell")
+	} else {
+		s.client.audit(command)
+	}
+	// Restricted clients only get the goos command, run without a shell
+	// so nothing else can be smuggled in. This holds for a certificate's
+	// force-command too: the ACL limits the principal whatever the CA
+	// signed.
+	if s.client.allowed != nil {
+		args := splitWords(command)
+		if len(args) == 0 || path.Base(args[0]) != "goos" {
+			audit("denied", "ip", s.client.ip, "fp", s.client.fp, "command", command)
+			go func() {
+				defer s.channel.Close()
+				fmt.Fprintln(s.channel.Stderr(), "goos-sshd: only the goos command is permitted for this key")
+				sendExitStatus(s.channel, 1)
+			}()
+			return
+		}
+		go runCommand(s.channel, s.pty, s.env, "goos", args[1:]...)
+		return
+	}
+	if command == internalSFTP {
+		go serveSFTP(s.channel, s.client.fsys)
+		return
+	}
+	if cmd, ok := parseSCP(command); ok {
+		go serveSCP(s.channel, s.client.fsys, cmd)
+		return
+	}
+	if command == "" {
+		go runCommand(s.channel, s.pty, s.env, shell)
+		return
+	}
+	// Run through the shell like OpenSSH does.
+	go runCommand(s.channel, s.pty, s.env, shell, "-c", command)
+}
+
+// runCommand runs cmd on the channel, on the pty if one was requested,
+// and reports its exit status.
+func runCommand(channel ssh.Channel, p *pty, env []string, cmd string, args ...string) {
+	defer channel.Close()
+	c := exec.Command(cmd, args...)
+	c.Env = env
+	if p != nil {
+		defer p.close()
+		c.Stdin, c.Stdout, c.Stderr = p.pts, p.pts, p.pts
+		c.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		if err := c.Start(); err != nil {
+			fmt.Fprintf(channel.Stderr(), "%v\r\n", err)
+			sendExitStatus(channel, 127)
+			return
+		}
+		p.pts.Close()
+		go io.Copy(p.ptm, channel)
+		io.Copy(channel, p.ptm)
+	} else {
+		// Copy stdin ourselves: Wait would otherwise block until the
+		// client closes its end, even after the command has exited.
+		stdin, err := c.StdinPipe()
+		if err != nil {
+			sendExitStatus(channel, 127)
+			return
+		}
+		c.Stdout, c.Stderr = channel, channel.Stderr()
+		if err := c.Start(); err != nil {
+			fmt.Fprintf(channel.Stderr(), "%v\n", err)
+			sendExitStatus(channel, 127)
+			return
+		}
+		go func() {
+			io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+	}
+	err := c.Wait()
+	code := 0
+	if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ExitCode()
+	}
+	sendExitStatus(channel, code)
+}
+
+func sendExitStatus(channel ssh.Channel, code int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{uint32(code)}))
+}
+
+type pty struct {
+	ptm, pts *os.File
+}
+
+func newPTY(cols, rows uint32) (*pty, error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.IoctlSetPointerInt(int(ptm.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		ptm.Close()
+		return nil, fmt.Errorf("unlockpt: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(ptm.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		ptm.Close()
+		return nil, fmt.Errorf("ptsname: %w", err)
+	}
+	pts, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, err
+	}
+	p := &pty{ptm: ptm, pts: pts}
+	_ = p.resize(cols, rows)
+	return p, nil
+}
+
+func (p *pty) resize(cols, rows uint32) error {
+	return unix.IoctlSetWinsize(int(p.ptm.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Col: uint16(cols),
+		Row: uint16(rows),
+	})
+}
+
+func (p *pty) close() {
+	p.ptm.Close()
+	p.pts.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpHandler serves SFTP requests from a fileSystem.
+type sftpHandler struct {
+	fsys *fileSystem
+}
+
+func serveSFTP(channel ssh.Channel, fsys *fileSystem) {
+	defer channel.Close()
+	h := &sftpHandler{fsys: fsys}
+	s := sftp.NewRequestServer(channel, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}, sftp.WithStartDirectory("/"))
+	if err := s.Serve(); err != nil && err != io.EOF {
+		log.Printf("sftp: %v", err)
+	}
+	sendExitStatus(channel, 0)
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return h.fsys.open(r.Filepath)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.OpenFile(r)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	pf := r.Pflags()
+	flag := os.O_WRONLY
+	if pf.Read {
+		flag = os.O_RDWR
+	}
+	// Append is left to the client's offsets: O_APPEND breaks WriteAt.
+	if pf.Creat {
+		flag |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flag |= os.O_EXCL
+	}
+	perm := fs.FileMode(0o644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+	return h.fsys.openFile(r.Filepath, flag, perm)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		// SFTP v3 renames must not replace an existing file.
+		if _, err := h.fsys.lstat(r.Target); err == nil {
+			return fs.ErrExist
+		}
+		return h.fsys.rename(r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		return h.fsys.remove(r.Filepath)
+	case "Mkdir":
+		return h.fsys.mkdir(r.Filepath, 0o755)
+	case "Link":
+		return h.fsys.link(r.Filepath, r.Target)
+	case "Symlink":
+		// Filepath is the link target and Target the new link.
+		return h.fsys.symlink(r.Filepath, r.Target)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	return h.fsys.rename(r.Filepath, r.Target)
+}
+
+func (h *sftpHandler) setstat(r *sftp.Request) error {
+	host, err := h.fsys.writable("setstat", r.Filepath, true)
+	if err != nil {
+		return err
+	}
+	a, flags := r.Attributes(), r.AttrFlags()
+	if flags.Size {
+		if err := os.Truncate(host, int64(a.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(host, a.FileMode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(host, int(a.UID), int(a.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(host, a.AccessTime(), a.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		fis, err := h.fsys.readDir(r.Filepath)
+		return listerAt(fis), err
+	case "Stat":
+		fi, err := h.fsys.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fi, err := h.fsys.lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+func (h *sftpHandler) Readlink(name string) (string, error) {
+	return h.fsys.readlink(name)
+}
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(fis []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fis, l[offset:])
+	if n < len(fis) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+var (
+	_ sftp.OpenFileWriter       = (*sftpHandler)(nil)
+	_ sftp.PosixRenameFileCmder = (*sftpHandler)(nil)
+	_ sftp.LstatFileLister      = (*sftpHandler)(nil)
+	_ sftp.ReadlinkFileLister   = (*sftpHandler)(nil)
+)
@@ -0,0 +1,124 @@
+// goos-uki is the host-side tool that builds GOOS Unified Kernel Images
+// and signs EFI binaries for Secure Boot.
+//
+//	goos-uki build -stub linuxx64.efi.stub -linux vmlinuz -initrd initramfs.cpio \
+//	    -cmdline "console=ttyS0" [-version V] [-key db.key -cert db.crt] -o goos.efi
+//	goos-uki sign -key db.key -cert db.crt -o BOOTX64.EFI systemd-bootx64.efi
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vpereira/goos/internal/uki"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("goos-uki: ")
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+	var err error
+	switch os.Args[1] {
+	case "build":
+		err = build(args)
+	case "sign":
+		err = sign(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: goos-uki build|sign [flags] ...")
+	os.Exit(2)
+}
+
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	stubPath := fs.String("stub", "", "systemd-stub, e.g. linuxx64.efi.stub")
+	linux := fs.String("linux", "", "Kernel image")
+	initrd := fs.String("initrd", "", "Initramfs")
+	cmdline := fs.String("cmdline", "", "Kernel cmdline embedded in the image")
+	version := fs.String("version", "dev", "Version shown by systemd-boot")
+	keyPath := fs.String("key", "", "Secure Boot signing key (PEM); unsigned without it")
+	certPath := fs.String("cert", "", "Secure Boot certificate (PEM)")
+	out := fs.String("o", "goos.efi", "Output file")
+	_ = fs.Parse(args)
+	if *stubPath == "" || *linux == "" {
+		return errors.New("usage: goos-uki build -stub STUB -linux KERNEL [-initrd INITRD] [-cmdline CMDLINE] -o OUT")
+	}
+	key, cert, err := loadSigner(*keyPath, *certPath)
+	if err != nil {
+		return err
+	}
+	stub, err := os.ReadFile(*stubPath)
+	if err != nil {
+		return err
+	}
+	opts := uki.Options{Cmdline: *cmdline, OSRel: uki.OSRelease(*version)}
+	if opts.Linux, err = os.ReadFile(*linux); err != nil {
+		return err
+	}
+	if *initrd != "" {
+		if opts.Initrd, err = os.ReadFile(*initrd); err != nil {
+			return err
+		}
+	}
+	img, err := uki.Build(stub, opts)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if img, err = uki.Sign(img, key, cert); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(*out, img, 0o644)
+}
+
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "Secure Boot signing key (PEM)")
+	certPath := fs.String("cert", "", "Secure Boot certificate (PEM)")
+	out := fs.String("o", "", "Output file; defaults to signing in place")
+	_ = fs.Parse(args)
+	if *keyPath == "" || fs.NArg() != 1 {
+		return errors.New("usage: goos-uki sign -key KEY -cert CERT [-o OUT] FILE")
+	}
+	key, cert, err := loadSigner(*keyPath, *certPath)
+	if err != nil {
+		return err
+	}
+	img, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if img, err = uki.Sign(img, key, cert); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = fs.Arg(0)
+	}
+	return os.WriteFile(*out, img, 0o644)
+}
+
+func loadSigner(keyPath, certPath string) (crypto.Signer, *x509.Certificate, error) {
+	if keyPath == "" {
+		return nil, nil, nil
+	}
+	if certPath == "" {
+		return nil, nil, errors.New("-key needs -cert")
+	}
+	return uki.LoadSigner(keyPath, certPath)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/update"
+)
+
+// agentConfig is the goos-update config file, written by goos-init from
+// the update_* installer settings.
+type agentConfig struct {
+	client   *update.Client
+	interval time.Duration
+	window   window
+}
+
+func loadAgentConfig(path string) (*agentConfig, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	url := cfg.Get("url")
+	if url == "" {
+		return nil, fmt.Errorf("%s: no url", path)
+	}
+	ac := &agentConfig{
+		client: &update.Client{
+			BaseURL:        url,
+			HTTP:           &http.Client{Timeout: 30 * time.Minute},
+			AllowDowngrade: cfg.Bool("allow_downgrade", false),
+		},
+		interval: 6 * time.Hour,
+	}
+	if v := cfg.Get("interval"); v != "" {
+		if ac.interval, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("%s: interval: %w", path, err)
+		}
+	}
+	if v := cfg.Get("window"); v != "" {
+		if ac.window, err = parseWindow(v); err != nil {
+			return nil, fmt.Errorf("%s: window: %w", path, err)
+		}
+	}
+	// Bundles are only trusted when signed by the key baked into the
+	// initramfs; without one the agent refuses to run.
+	if ac.client.PublicKey, err = bundle.LoadPublicKey(bundle.TrustRoot); err != nil {
+		return nil, fmt.Errorf("trust root: %w", err)
+	}
+	return ac, nil
+}
+
+// window is a daily UTC time range, in minutes after midnight, in which
+// the agent may reboot. The zero window allows any time.
+type window struct {
+	from, to int
+	set      bool
+}
+
+// parseWindow reads "HH:MM-HH:MM". The range may wrap past midnight but
+// not be empty, which would never let an update through.
+func parseWindow(s string) (window, error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, errors.New("want HH:MM-HH:MM")
+	}
+	from, err := time.Parse("15:04", strings.TrimSpace(a))
+	if err != nil {
+		return window{}, err
+	}
+	to, err := time.Parse("15:04", strings.TrimSpace(b))
+	if err != nil {
+		return window{}, err
+	}
+	w := window{
+		from: from.Hour()*60 + from.Minute(),
+		to:   to.Hour()*60 + to.Minute(),
+		set:  true,
+	}
+	if w.from == w.to {
+		return window{}, errors.New("empty window; leave update_window unset to allow any time")
+	}
+	return w, nil
+}
+
+func (w window) contains(t time.Time) bool {
+	if !w.set {
+		return true
+	}
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return m >= w.from && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+func (w window) String() string {
+	if !w.set {
+		return "now"
+	}
+	return fmt.Sprintf("in %02d:%02d-%02d:%02d UTC", w.from/60, w.from%60, w.to/60, w.to%60)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := parseWindow("02:30 - 04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.from != 150 || w.to != 240 || !w.set {
+		t.Errorf("parseWindow = %+v", w)
+	}
+	if s := w.String(); s != "in 02:30-04:00 UTC" {
+		t.Errorf("String = %q", s)
+	}
+	for _, bad := range []string{"", "02:30", "2:30pm-4", "25:00-01:00", "02:30-24:00", "02:00-02:00", "00:00 - 00:00"} {
+		if _, err := parseWindow(bad); err == nil {
+			t.Errorf("parseWindow(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t.Helper()
+		v, err := time.Parse("15:04", hhmm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2026, 10, 18, v.Hour(), v.Minute(), 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		window string
+		at     string
+		want   bool
+	}{
+		{"02:00-04:00", "01:59", false},
+		{"02:00-04:00", "02:00", true},
+		{"02:00-04:00", "03:59", true},
+		{"02:00-04:00", "04:00", false},
+		// Across midnight.
+		{"23:00-01:00", "22:59", false},
+		{"23:00-01:00", "23:00", true},
+		{"23:00-01:00", "00:00", true},
+		{"23:00-01:00", "00:59", true},
+		{"23:00-01:00", "01:00", false},
+		{"23:00-01:00", "12:00", false},
+	} {
+		w, err := parseWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(at(tt.at)); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.window, tt.at, got, tt.want)
+		}
+	}
+
+	// The window is in UTC whatever the local zone.
+	w, _ := parseWindow("23:00-01:00")
+	if !w.contains(time.Date(2026, 10, 18, 2, 30, 0, 0, time.FixedZone("CEST", 2*3600))) {
+		t.Error("00:30 UTC given in CEST is outside 23:00-01:00")
+	}
+	if !(window{}).contains(at("12:00")) || (window{}).String() != "now" {
+		t.Error("the zero window does not allow any time")
+	}
+}
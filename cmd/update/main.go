@@ -0,0 +1,102 @@
+// goos-update is the over-the-air update agent started by goos-init. It
+// polls for update bundles, stages them into the inactive boot slot and
+// reboots into them inside the maintenance window. The new slot is on
+// trial until goos-init blesses it, so a bad bundle falls back by itself.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+	"github.com/vpereira/goos/internal/update"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	configPath = flag.String("config", "/run/goos/update.conf", "Path of the goos-update config written by goos-init")
+	once       = flag.Bool("once", false, "Check once, print the result as JSON and exit")
+)
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("goos-update: ")
+	ac, err := loadAgentConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	booted, ok := cmdline.Value("goos.slot")
+	if !ok {
+		log.Fatal("not booted from a boot slot")
+	}
+	if *once {
+		res, err := check(ac, booted)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(res)
+		return
+	}
+	// Bundles are checked every interval; a staged slot is looked for every
+	// minute so a short window is not missed.
+	var next time.Time
+	for {
+		if now := time.Now(); !now.Before(next) {
+			next = now.Add(ac.interval)
+			if res, err := check(ac, booted); err != nil {
+				log.Print(err)
+			} else if res.Staged {
+				log.Printf("staged %s in slot %s; rebooting %s", res.Version, res.Slot, ac.window)
+			}
+		}
+		if slot, ok := update.Pending(config.ESPMount, booted); ok && ac.window.contains(time.Now()) {
+			log.Printf("rebooting into slot %s", slot)
+			_ = os.WriteFile("/dev/kmsg", []byte("goos-update: rebooting into slot "+slot+"\n"), 0o644)
+			syscall.Sync()
+			if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART); err != nil {
+				log.Print(err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// lockPath serialises staging between the agent and goos-update -once,
+// which goos upgrade runs while the agent may be staging too.
+const lockPath = "/run/goos/update.lock"
+
+func check(ac *agentConfig, booted string) (update.Result, error) {
+	unlock, err := lock(lockPath)
+	if err != nil {
+		return update.Result{Booted: booted}, err
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	return update.Stage(ctx, ac.client, config.ESPMount, booted)
+}
+
+// lock takes an exclusive flock on path, waiting for any other holder.
+// The lock goes away with the process, so a crash cannot leave it stale.
+func lock(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return func() { f.Close() }, nil
+}
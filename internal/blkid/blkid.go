@@ -0,0 +1,223 @@
+// Package blkid finds filesystem, RAID, LVM, LUKS and partition table
+// signatures on a block device, like blkid and wipefs do. Each Signature
+// records where its magic is, so it can also be erased.
+package blkid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Partition table types.
+const (
+	GPT = "gpt"
+	DOS = "dos"
+	// PMBR is the protective MBR in front of a GPT.
+	PMBR = "PMBR"
+)
+
+// Signature is one magic found on the device.
+type Signature struct {
+	Type   string // e.g. vfat, ext4, LVM2_member, gpt
+	Label  string
+	Offset int64
+	Magic  []byte
+}
+
+// probe describes a magic at a fixed offset and where the label is.
+type probe struct {
+	typ      string
+	offset   int64
+	magic    string
+	labelOff int64
+	labelLen int
+}
+
+var probes = []probe{
+	{"xfs", 0, "XFSB", 0x6c, 12},
+	{"squashfs", 0, "hsqs", 0, 0},
+	{"crypto_LUKS", 0, "LUKS\xba\xbe", 0, 0},
+	{"ntfs", 3, "NTFS    ", 0, 0},
+	{"erofs", 0x400, "\xe2\xe1\xf5\xe0", 0, 0},
+	{"ext4", 0x438, "\x53\xef", 0x478, 16},
+	{"linux_raid_member", 0, "\xfc\x4e\x2b\xa9", 32, 32},
+	{"linux_raid_member", 0x1000, "\xfc\x4e\x2b\xa9", 0x1020, 32},
+	{"swap", 0xff6, "SWAPSPACE2", 0x41c, 16},
+	{"swap", 0xff6, "SWAP-SPACE", 0, 0},
+	{"swap", 0x1ff6, "SWAPSPACE2", 0x41c, 16},
+	{"swap", 0xfff6, "SWAPSPACE2", 0x41c, 16},
+	{"iso9660", 0x8001, "CD001", 0x8028, 32},
+	{"btrfs", 0x10040, "_BHRfS_M", 0x1012b, 256},
+	{"zfs_member", 0x20000, "\x0c\xb1\xba\x00\x00\x00\x00\x00", 0, 0},
+	{"zfs_member", 0x20000, "\x00\x00\x00\x00\x00\xba\xb1\x0c", 0, 0},
+	{"zfs_member", 0x60000, "\x0c\xb1\xba\x00\x00\x00\x00\x00", 0, 0},
+	{"zfs_member", 0x60000, "\x00\x00\x00\x00\x00\xba\xb1\x0c", 0, 0},
+	{GPT, 0x200, "EFI PART", 0, 0},
+	{GPT, 0x1000, "EFI PART", 0, 0},
+}
+
+// Probe returns every signature found on a device of size bytes, in
+// offset order.
+func Probe(r io.ReaderAt, size int64) ([]Signature, error) {
+	var sigs []Signature
+	read := func(off int64, n int) []byte {
+		if off < 0 || off+int64(n) > size {
+			return nil
+		}
+		b := make([]byte, n)
+		if _, err := r.ReadAt(b, off); err != nil {
+			return nil
+		}
+		return b
+	}
+	add := func(typ string, off int64, magic string, label []byte) {
+		sigs = append(sigs, Signature{Type: typ, Label: cleanLabel(label), Offset: off, Magic: []byte(magic)})
+	}
+	if read(0, 512) == nil {
+		if size >= 512 {
+			return nil, errors.New("blkid: read error")
+		}
+		return nil, nil
+	}
+
+	for _, p := range probes {
+		if !bytes.Equal(read(p.offset, len(p.magic)), []byte(p.magic)) {
+			continue
+		}
+		var label []byte
+		if p.labelLen > 0 {
+			label = read(p.labelOff, p.labelLen)
+		}
+		add(p.typ, p.offset, p.magic, label)
+	}
+
+	// FAT and MBRs share the 0x55AA boot signature.
+	if boot := read(0, 512); boot[510] == 0x55 && boot[511] == 0xaa {
+		switch {
+		case string(boot[0x52:0x57]) == "FAT32" && binary.LittleEndian.Uint16(boot[11:]) != 0:
+			add("vfat", 0x52, string(boot[0x52:0x5a]), boot[0x47:0x52])
+			add("vfat", 0x1fe, "\x55\xaa", nil)
+		case string(boot[0x36:0x39]) == "FAT" && binary.LittleEndian.Uint16(boot[11:]) != 0:
+			add("vfat", 0x36, string(boot[0x36:0x3e]), boot[0x2b:0x36])
+			add("vfat", 0x1fe, "\x55\xaa", nil)
+		case boot[0x1c2] == 0xee:
+			add(PMBR, 0x1fe, "\x55\xaa", nil)
+		default:
+			add(DOS, 0x1fe, "\x55\xaa", nil)
+		}
+	}
+
+	// LVM puts its label in one of the first four sectors.
+	for s := int64(0); s < 4; s++ {
+		if string(read(s*512, 8)) == "LABELONE" && string(read(s*512+24, 8)) == "LVM2 001" {
+			add("LVM2_member", s*512+24, "LVM2 001", nil)
+		}
+	}
+
+	// LUKS2 keeps a second header after the first, at 16 KiB to 4 MiB.
+	for off := int64(0x4000); off <= 0x400000; off <<= 1 {
+		if string(read(off, 6)) == "SKUL\xba\xbe" {
+			add("crypto_LUKS", off, "SKUL\xba\xbe", nil)
+		}
+	}
+
+	// Signatures at the end of the device: mdraid 1.0 and 0.90, the
+	// trailing ZFS labels and the backup GPT header.
+	if md := (size/512 - 16) &^ 7 * 512; md > 0 && string(read(md, 4)) == "\xfc\x4e\x2b\xa9" {
+		add("linux_raid_member", md, "\xfc\x4e\x2b\xa9", read(md+32, 32))
+	}
+	if md := size&^0xffff - 0x10000; md > 0 && string(read(md, 4)) == "\xfc\x4e\x2b\xa9" {
+		add("linux_raid_member", md, "\xfc\x4e\x2b\xa9", nil)
+	}
+	if md := size&^0xffff - 0x10000; md > 0 && string(read(md, 4)) == "\xa9\x2b\x4e\xfc" {
+		add("linux_raid_member", md, "\xa9\x2b\x4e\xfc", nil)
+	}
+	zfsEnd := size&^0x3ffff - 0x80000
+	for _, off := range []int64{zfsEnd + 0x20000, zfsEnd + 0x60000} {
+		for _, magic := range []string{"\x0c\xb1\xba\x00\x00\x00\x00\x00", "\x00\x00\x00\x00\x00\xba\xb1\x0c"} {
+			if off > 0x60000 && string(read(off, 8)) == magic {
+				add("zfs_member", off, magic, nil)
+			}
+		}
+	}
+	for _, sector := range []int64{512, 4096} {
+		if off := size - sector; off > 0x1000 && string(read(off, 8)) == "EFI PART" {
+			add(GPT, off, "EFI PART", nil)
+		}
+	}
+
+	sort.SliceStable(sigs, func(i, j int) bool { return sigs[i].Offset < sigs[j].Offset })
+	return sigs, nil
+}
+
+// ProbeFile probes the block device or image at path.
+func ProbeFile(path string) ([]Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return Probe(f, size)
+}
+
+// Erase zeroes the magic of each signature, the way wipefs -a does.
+func Erase(w io.WriterAt, sigs []Signature) error {
+	for _, s := range sigs {
+		if _, err := w.WriteAt(make([]byte, len(s.Magic)), s.Offset); err != nil {
+			return fmt.Errorf("erase %s at %#x: %w", s.Type, s.Offset, err)
+		}
+	}
+	return nil
+}
+
+// IsTable reports whether typ is a partition table type.
+func IsTable(typ string) bool {
+	return typ == GPT || typ == DOS || typ == PMBR
+}
+
+// Table returns the partition table type, GPT winning over its protective
+// MBR, or "".
+func Table(sigs []Signature) string {
+	table := ""
+	for _, s := range sigs {
+		if s.Type == GPT {
+			return GPT
+		}
+		if IsTable(s.Type) {
+			table = s.Type
+		}
+	}
+	if table == PMBR {
+		// A protective MBR without a GPT header.
+		return GPT
+	}
+	return table
+}
+
+// Content returns the first signature that is not a partition table:
+// the filesystem, RAID member, LVM PV or LUKS volume on the device.
+func Content(sigs []Signature) (Signature, bool) {
+	for _, s := range sigs {
+		if !IsTable(s.Type) {
+			return s, true
+		}
+	}
+	return Signature{}, false
+}
+
+func cleanLabel(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
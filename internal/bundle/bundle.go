@@ -0,0 +1,210 @@
+// Package bundle is the signed format of GOOS boot artifacts, used for the
+// ISO's boot files and for update bundles.
+//
+// A bundle directory holds the artifacts plus:
+//
+//	manifest.json   version and SHA-256 digest and size of every artifact
+//	manifest.sig    base64 ed25519 signature of manifest.json
+//
+// Keys are base64 lines: 32 bytes for a public key, 64 for a private key.
+package bundle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the files in a bundle.
+const (
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.sig"
+	KernelName    = "vmlinuz"
+	InitrdName    = "initramfs.cpio"
+	EntryName     = "entry.conf"
+	UKIName       = "goos.efi"
+)
+
+// TrustRoot is the public key the Makefile bakes into the initramfs. Only
+// bundles signed by it are installed or booted.
+const TrustRoot = "/etc/goos/bundle.pub"
+
+// Manifest describes a bundle.
+type Manifest struct {
+	Version string          `json:"version"`
+	Files   map[string]File `json:"files"`
+}
+
+// File is an artifact's expected size and SHA-256 digest in hex.
+type File struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Create hashes the named files in dir into a manifest.
+func Create(dir, version string, names []string) ([]byte, error) {
+	if version == "" {
+		return nil, errors.New("no version")
+	}
+	m := Manifest{Version: version, Files: map[string]File{}}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		m.Files[name] = File{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Parse reads a manifest and checks it names a kernel and initramfs.
+func Parse(raw []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", ManifestName, err)
+	}
+	if m.Version == "" {
+		return nil, fmt.Errorf("%s: no version", ManifestName)
+	}
+	for _, name := range []string{KernelName, InitrdName} {
+		if _, ok := m.Files[name]; !ok {
+			return nil, fmt.Errorf("%s: no %s", ManifestName, name)
+		}
+	}
+	return &m, nil
+}
+
+// Check reads r to the end and compares it with the manifest's entry for
+// name.
+func (m *Manifest) Check(name string, r io.Reader) error {
+	want, ok := m.Files[name]
+	if !ok {
+		return fmt.Errorf("%s not in manifest", name)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(r, want.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != want.Size {
+		return fmt.Errorf("%s: got %d bytes, want %d", name, n, want.Size)
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), want.SHA256) {
+		return fmt.Errorf("%s: SHA-256 mismatch", name)
+	}
+	return nil
+}
+
+// Sign returns the base64 signature line for manifest.
+func Sign(priv ed25519.PrivateKey, manifest []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest)) + "\n")
+}
+
+// Verify checks a base64 signature of manifest.
+func Verify(pub ed25519.PublicKey, manifest, sig []byte) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", SignatureName, err)
+	}
+	if !ed25519.Verify(pub, manifest, b) {
+		return errors.New("bad manifest signature")
+	}
+	return nil
+}
+
+// VerifyDir checks the signed manifest in dir and the named files against
+// it.
+func VerifyDir(pub ed25519.PublicKey, dir string, names ...string) (*Manifest, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := os.ReadFile(filepath.Join(dir, SignatureName))
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(pub, raw, sig); err != nil {
+		return nil, err
+	}
+	m, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		err = m.Check(name, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// GenerateKey returns a new key pair as base64 lines.
+func GenerateKey() (pub, priv []byte, err error) {
+	p, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(p) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(k) + "\n"), nil
+}
+
+// ParsePublicKey decodes a base64 public key.
+func ParsePublicKey(b []byte) (ed25519.PublicKey, error) {
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(k) != ed25519.PublicKeySize {
+		return nil, errors.New("not a base64 ed25519 public key")
+	}
+	return k, nil
+}
+
+// LoadPublicKey reads a public key file.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// LoadPrivateKey reads a private key file.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(k) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: not a base64 ed25519 private key", path)
+	}
+	return k, nil
+}
@@ -0,0 +1,23 @@
+// Package cmdline reads goos.* options from the kernel command line.
+package cmdline
+
+import (
+	"os"
+	"strings"
+)
+
+// Value returns the value of key=value on the kernel command line. A bare
+// key without '=' is reported as present with an empty value.
+func Value(key string) (string, bool) {
+	b, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", false
+	}
+	for _, f := range strings.Fields(string(b)) {
+		k, v, _ := strings.Cut(f, "=")
+		if k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,179 @@
+// Package config reads the key=value files written by goos-installer and
+// consumed by goos-init at boot.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ESPMount is where goos-init mounts the EFI system partition.
+	ESPMount = "/esp"
+	// Path is the installer config file, relative to the ESP root.
+	Path = "/etc/goos-installer.conf"
+)
+
+// Config is a flat set of key=value settings.
+type Config map[string]string
+
+// Parse reads key=value lines. Blank lines and lines starting with '#'
+// are ignored; anything else without an '=' is an error.
+func Parse(r io.Reader) (Config, error) {
+	cfg := Config{}
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing '='", n)
+		}
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return nil, fmt.Errorf("line %d: empty key", n)
+		}
+		cfg[k] = strings.TrimSpace(v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load parses the config file at path.
+func Load(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Get returns the value for key, or "" if unset.
+func (c Config) Get(key string) string {
+	return c[key]
+}
+
+// Bool returns key parsed as a boolean, or def if unset or invalid.
+func (c Config) Bool(key string, def bool) bool {
+	v, ok := c[key]
+	if !ok || v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// List returns key split on commas, with empty items dropped.
+func (c Config) List(key string) []string {
+	return SplitList(c[key])
+}
+
+// SplitList splits a comma-separated value, dropping empty items.
+func SplitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Prefixed returns the non-empty values of key and of every "key.<name>"
+// entry, ordered by key name.
+func (c Config) Prefixed(key string) []string {
+	var names []string
+	for k := range c {
+		if k == key || strings.HasPrefix(k, key+".") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var out []string
+	for _, k := range names {
+		if v := c[k]; v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Keys returns the keys of c in sorted order.
+func (c Config) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Merge copies every entry of o into c, overriding existing keys.
+func (c Config) Merge(o Config) {
+	for k, v := range o {
+		c[k] = v
+	}
+}
+
+// Update rewrites the config file at path in place: keys in set get their
+// new value (appended if missing) and keys in del are dropped. Comments
+// and line order are kept.
+func Update(path string, set Config, del ...string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	drop := map[string]bool{}
+	for _, k := range del {
+		drop[k] = true
+	}
+	done := map[string]bool{}
+	var out strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		k, _, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		_, replace := set[k]
+		switch {
+		case !ok || strings.HasPrefix(k, "#"):
+			out.WriteString(line + "\n")
+		case drop[k]:
+		case replace:
+			if !done[k] {
+				fmt.Fprintf(&out, "%s=%s\n", k, set[k])
+				done[k] = true
+			}
+		default:
+			out.WriteString(line + "\n")
+		}
+	}
+	var keys []string
+	for k := range set {
+		if !done[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&out, "%s=%s\n", k, set[k])
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(out.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,239 @@
+// Package efivar reads and writes UEFI variables through efivarfs and
+// manages Boot#### load options the way efibootmgr does.
+//
+// An efivarfs file is the variable's 4-byte attributes followed by its
+// data; it has to be written in one write() call. The kernel marks most
+// variables immutable, so that flag is cleared before writing.
+package efivar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Dir is where efivarfs is mounted.
+	Dir = "/sys/firmware/efi/efivars"
+	// GlobalGUID is the vendor GUID of the Boot#### and BootOrder
+	// variables.
+	GlobalGUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+	NonVolatile       = 0x1
+	BootserviceAccess = 0x2
+	RuntimeAccess     = 0x4
+
+	// fsImmutable is FS_IMMUTABLE_FL.
+	fsImmutable = 0x10
+)
+
+// Supported reports whether the system was booted through UEFI.
+func Supported() bool {
+	_, err := os.Stat("/sys/firmware/efi")
+	return err == nil
+}
+
+// Mount mounts efivarfs at Dir unless it already is.
+func Mount() error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(Dir, &st); err == nil && st.Type == unix.EFIVARFS_MAGIC {
+		return nil
+	}
+	return syscall.Mount("efivarfs", Dir, "efivarfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+}
+
+func path(name, guid string) string {
+	return filepath.Join(Dir, name+"-"+strings.ToLower(guid))
+}
+
+// Read returns a variable's attributes and data.
+func Read(name, guid string) (uint32, []byte, error) {
+	b, err := os.ReadFile(path(name, guid))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("%s: short variable", name)
+	}
+	return binary.LittleEndian.Uint32(b), b[4:], nil
+}
+
+// Write sets a variable, creating it if needed.
+func Write(name, guid string, attrs uint32, data []byte) error {
+	p := path(name, guid)
+	if err := setMutable(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, attrs)
+	copy(buf[4:], data)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+func setMutable(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil || flags&fsImmutable == 0 {
+		return err
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags&^fsImmutable)
+}
+
+// HardDrive names a GPT partition for a HD() device path node.
+type HardDrive struct {
+	Number uint32 // partition number, from 1
+	Start  uint64 // first LBA
+	Size   uint64 // size in LBAs
+	GUID   string // partition GUID
+}
+
+// LoadOption is an EFI_LOAD_OPTION that starts Path on a partition.
+type LoadOption struct {
+	Description string
+	Partition   HardDrive
+	Path        string // e.g. \EFI\BOOT\BOOTX64.EFI
+}
+
+// Marshal encodes the load option with the device path
+// HD(...)/File(Path)/End.
+func (o LoadOption) Marshal() ([]byte, error) {
+	g, err := uuid.Parse(o.Partition.GUID)
+	if err != nil {
+		return nil, fmt.Errorf("partition GUID: %w", err)
+	}
+	le := binary.LittleEndian
+
+	hd := make([]byte, 42)
+	hd[0], hd[1] = 0x04, 0x01 // MEDIA_DEVICE_PATH, MEDIA_HARDDRIVE_DP
+	le.PutUint16(hd[2:], 42)
+	le.PutUint32(hd[4:], o.Partition.Number)
+	le.PutUint64(hd[8:], o.Partition.Start)
+	le.PutUint64(hd[16:], o.Partition.Size)
+	copy(hd[24:40], guidBytes(g))
+	hd[40] = 0x02 // GPT
+	hd[41] = 0x02 // signature is a GUID
+
+	name := ucs2(o.Path)
+	file := make([]byte, 4, 4+len(name))
+	file[0], file[1] = 0x04, 0x04 // MEDIA_DEVICE_PATH, MEDIA_FILEPATH_DP
+	le.PutUint16(file[2:], uint16(4+len(name)))
+	file = append(file, name...)
+
+	end := []byte{0x7f, 0xff, 0x04, 0x00}
+
+	paths := append(append(hd, file...), end...)
+	out := make([]byte, 6, 6+len(paths)+2*len(o.Description)+2)
+	le.PutUint32(out, 1) // LOAD_OPTION_ACTIVE
+	le.PutUint16(out[4:], uint16(len(paths)))
+	out = append(out, ucs2(o.Description)...)
+	return append(out, paths...), nil
+}
+
+// loadOptionDescription decodes the description of an EFI_LOAD_OPTION.
+func loadOptionDescription(b []byte) string {
+	var u []uint16
+	for i := 6; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// guidBytes is the EFI GUID layout: the first three fields little-endian.
+func guidBytes(g uuid.UUID) []byte {
+	b := make([]byte, 16)
+	copy(b, g[:])
+	b[0], b[1], b[2], b[3] = g[3], g[2], g[1], g[0]
+	b[4], b[5] = g[5], g[4]
+	b[6], b[7] = g[7], g[6]
+	return b
+}
+
+// ucs2 encodes s as NUL-terminated UTF-16LE.
+func ucs2(s string) []byte {
+	u := utf16.Encode([]rune(s + "\x00"))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// SetBootEntry writes o to the Boot#### variable already carrying its
+// description, or to the lowest free one, and puts it first in
+// BootOrder. It returns the entry number.
+func SetBootEntry(o LoadOption) (uint16, error) {
+	data, err := o.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	used := map[uint16]bool{}
+	num, found := uint16(0), false
+	entries, err := os.ReadDir(Dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		var n uint16
+		name, ok := strings.CutSuffix(e.Name(), "-"+GlobalGUID)
+		if !ok || len(name) != 8 || !strings.HasPrefix(name, "Boot") {
+			continue
+		}
+		if _, err := fmt.Sscanf(name[4:], "%04X", &n); err != nil {
+			continue
+		}
+		used[n] = true
+		if found {
+			continue
+		}
+		if _, b, err := Read(name, GlobalGUID); err == nil && loadOptionDescription(b) == o.Description {
+			num, found = n, true
+		}
+	}
+	for !found && used[num] {
+		num++
+	}
+	attrs := uint32(NonVolatile | BootserviceAccess | RuntimeAccess)
+	if err := Write(fmt.Sprintf("Boot%04X", num), GlobalGUID, attrs, data); err != nil {
+		return 0, err
+	}
+
+	order := []byte{byte(num), byte(num >> 8)}
+	if _, cur, err := Read("BootOrder", GlobalGUID); err == nil {
+		for i := 0; i+1 < len(cur); i += 2 {
+			if binary.LittleEndian.Uint16(cur[i:]) != num {
+				order = append(order, cur[i], cur[i+1])
+			}
+		}
+	}
+	if err := Write("BootOrder", GlobalGUID, attrs, order); err != nil {
+		return 0, err
+	}
+	return num, nil
+}
@@ -0,0 +1,32 @@
+// Package layout names the partitions goos-installer creates and goos-init
+// looks for at boot.
+package layout
+
+const (
+	// ESPName is the GPT name of the EFI system partition.
+	ESPName = "EFI System"
+	// ESPSize leaves room for several kernels and initramfs images.
+	ESPSize = 512 << 20
+
+	// RootName is the GPT name and ext4 label of the optional root partition.
+	RootName = "GOOS-ROOT"
+	// RootType is the Discoverable Partitions Specification type for an
+	// x86-64 root partition.
+	RootType = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	// RootSize holds the GOOS userland with room for larger ones.
+	RootSize = 1 << 30
+
+	// StateName is the GPT name and ext4 label of the state partition.
+	StateName = "GOOS-STATE"
+	// StateType is the Discoverable Partitions Specification type for /var.
+	StateType = "4D21B016-B534-45C2-A9FB-5C16E091FD2D"
+	// StateSize is the size at install; goos-init grows the partition to
+	// the end of the disk on first boot.
+	StateSize = 256 << 20
+	// StateBlank is how much of the state partition the installer zeroes.
+	// goos-init only formats the partition when all of it reads as zeros,
+	// so it never formats over data it does not recognise.
+	StateBlank = 64 << 10
+	// StateMount is where goos-init mounts the state partition.
+	StateMount = "/var/lib/goos"
+)
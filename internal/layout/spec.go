@@ -0,0 +1,273 @@
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Partition roles in a layout Spec.
+const (
+	RoleESP   = "esp"
+	RoleBootA = "boot-a"
+	RoleBootB = "boot-b"
+	RoleRoot  = "root"
+	RoleState = "state"
+	RoleSwap  = "swap"
+)
+
+const (
+	// ESPType is the GPT type of the EFI system partition.
+	ESPType = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	// BootType is the GPT type of the boot A/B partitions, Linux
+	// filesystem data.
+	BootType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	// SwapType is the Discoverable Partitions Specification type for swap.
+	SwapType = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	// BootAName and BootBName are the GPT names of the boot partitions,
+	// which keep a copy of each slot's last blessed boot files.
+	BootAName = "GOOS-BOOT-A"
+	BootBName = "GOOS-BOOT-B"
+	// SwapName is the GPT name and swap label of the swap partition.
+	SwapName = "GOOS-SWAP"
+)
+
+// Part is one partition of a layout. Exactly one of Size and Percent is
+// set, or neither for the one partition that takes the rest of the disk.
+type Part struct {
+	Role    string
+	Label   string // GPT name
+	Type    string // GPT type GUID
+	Size    uint64 // bytes
+	Percent int    // of the disk space left for partitions
+}
+
+// Rest reports whether the partition takes the space the others leave.
+func (p Part) Rest() bool {
+	return p.Size == 0 && p.Percent == 0
+}
+
+// Spec is a partition layout, in disk order.
+type Spec []Part
+
+// DefaultSpec is the layout the installer uses when none is given: the
+// ESP, the root partition if root is set, and a small state partition
+// that goos-init grows to the end of the disk on first boot.
+func DefaultSpec(root bool) Spec {
+	s := Spec{defaultPart(RoleESP)}
+	s[0].Size = ESPSize
+	if root {
+		p := defaultPart(RoleRoot)
+		p.Size = RootSize
+		s = append(s, p)
+	}
+	p := defaultPart(RoleState)
+	p.Size = StateSize
+	return append(s, p)
+}
+
+// Presets are the named layouts ParseSpec accepts besides the full syntax.
+var Presets = map[string]string{
+	"default": "esp:512M,state:256M",
+	"root":    "esp:512M,root:1G,state:256M",
+	"ab":      "esp:512M,boot-a:256M,boot-b:256M,state:rest",
+	"swap":    "esp:512M,root:1G,swap:2G,state:rest",
+}
+
+func defaultPart(role string) Part {
+	switch role {
+	case RoleESP:
+		return Part{Role: role, Label: ESPName, Type: ESPType}
+	case RoleBootA:
+		return Part{Role: role, Label: BootAName, Type: BootType}
+	case RoleBootB:
+		return Part{Role: role, Label: BootBName, Type: BootType}
+	case RoleRoot:
+		return Part{Role: role, Label: RootName, Type: RootType}
+	case RoleState:
+		return Part{Role: role, Label: StateName, Type: StateType}
+	case RoleSwap:
+		return Part{Role: role, Label: SwapName, Type: SwapType}
+	}
+	return Part{}
+}
+
+// ParseSpec reads a preset name or a comma-separated list of
+//
+//	role:size[:label[:type]]
+//
+// where size is a byte count with an optional K, M, G or T suffix, a
+// percentage of the disk, or "rest". The label and GPT type default to the
+// ones goos-init looks for; they can only be changed for the roles
+// goos-init does not look up.
+func ParseSpec(s string) (Spec, error) {
+	s = strings.TrimSpace(s)
+	if p, ok := Presets[s]; ok {
+		s = p
+	}
+	var spec Spec
+	for _, item := range strings.Split(s, ",") {
+		f := strings.Split(strings.TrimSpace(item), ":")
+		if len(f) < 2 || len(f) > 4 {
+			return nil, fmt.Errorf("layout: %q: want role:size[:label[:type]]", item)
+		}
+		p := defaultPart(f[0])
+		if p.Role == "" {
+			return nil, fmt.Errorf("layout: unknown role %q", f[0])
+		}
+		if err := p.parseSize(f[1]); err != nil {
+			return nil, fmt.Errorf("layout: %s: %w", p.Role, err)
+		}
+		if len(f) > 2 && f[2] != "" {
+			p.Label = f[2]
+		}
+		if len(f) > 3 && f[3] != "" {
+			p.Type = strings.ToUpper(f[3])
+		}
+		spec = append(spec, p)
+	}
+	return spec, spec.Validate()
+}
+
+func (p *Part) parseSize(v string) error {
+	switch {
+	case v == "rest":
+		return nil
+	case strings.HasSuffix(v, "%"):
+		n, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || n <= 0 || n > 100 {
+			return fmt.Errorf("bad percentage %q", v)
+		}
+		p.Percent = n
+		return nil
+	}
+	n, err := ParseSize(v)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("size is zero")
+	}
+	p.Size = n
+	return nil
+}
+
+// fixedName reports whether goos-init finds the partition for role by its
+// GOOS name and type, so the layout must keep them.
+func fixedName(role string) bool {
+	switch role {
+	case RoleESP, RoleBootA, RoleBootB, RoleState, RoleSwap:
+		return true
+	}
+	return false
+}
+
+// Validate checks that the layout can be installed: the ESP comes first,
+// no role appears twice, the boot partitions come in pairs, the
+// partitions goos-init looks up keep their names and types, and at most
+// one partition takes the rest of the disk. The state partition is
+// optional; without one goos-init keeps its state in memory.
+func (s Spec) Validate() error {
+	if len(s) == 0 || s[0].Role != RoleESP {
+		return errors.New("layout: the esp partition must come first")
+	}
+	seen := map[string]bool{}
+	rest, pct := 0, 0
+	for _, p := range s {
+		if seen[p.Role] {
+			return fmt.Errorf("layout: more than one %s partition", p.Role)
+		}
+		seen[p.Role] = true
+		if p.Rest() {
+			rest++
+		}
+		pct += p.Percent
+		if len(p.Type) != 36 {
+			return fmt.Errorf("layout: %s: bad GPT type %q", p.Role, p.Type)
+		}
+		if len(p.Label) > 36 {
+			return fmt.Errorf("layout: %s: label longer than 36 characters", p.Role)
+		}
+		if d := defaultPart(p.Role); fixedName(p.Role) && (p.Label != d.Label || p.Type != d.Type) {
+			return fmt.Errorf("layout: %s: goos-init finds it as %s, so its label and type cannot change", p.Role, d.Label)
+		}
+	}
+	switch {
+	case seen[RoleBootA] != seen[RoleBootB]:
+		return errors.New("layout: boot-a and boot-b go together")
+	case rest > 1:
+		return errors.New("layout: only one partition can take the rest")
+	case pct > 100:
+		return errors.New("layout: percentages add up to more than 100")
+	}
+	return nil
+}
+
+// Has reports whether the layout has a partition for role.
+func (s Spec) Has(role string) bool {
+	return s.Index(role) >= 0
+}
+
+// Index returns the position of the partition for role, or -1.
+func (s Spec) Index(role string) int {
+	for i, p := range s {
+		if p.Role == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// String formats the layout in the ParseSpec syntax.
+func (s Spec) String() string {
+	var items []string
+	for _, p := range s {
+		size := "rest"
+		switch {
+		case p.Size != 0:
+			size = FormatSize(p.Size)
+		case p.Percent != 0:
+			size = strconv.Itoa(p.Percent) + "%"
+		}
+		item := p.Role + ":" + size
+		if d := defaultPart(p.Role); p.Type != d.Type {
+			item += ":" + p.Label + ":" + p.Type
+		} else if p.Label != d.Label {
+			item += ":" + p.Label
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+// ParseSize reads a byte count with an optional binary K, M, G or T
+// suffix, e.g. 512M or 1.5T.
+func ParseSize(s string) (uint64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := uint64(1)
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			v = v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return uint64(f * float64(mult)), nil
+}
+
+// FormatSize writes n in the largest unit that keeps it whole.
+func FormatSize(n uint64) string {
+	for _, u := range []struct {
+		suffix string
+		shift  uint
+	}{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}} {
+		if n >= 1<<u.shift && n%(1<<u.shift) == 0 {
+			return strconv.FormatUint(n>>u.shift, 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
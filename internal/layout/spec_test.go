@@ -0,0 +1,51 @@
+package layout
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"default", "esp:512M,state:256M"},
+		{"ab", "esp:512M,boot-a:256M,boot-b:256M,state:rest"},
+		{"esp:512M,root:2G,swap:10%,state:rest", "esp:512M,root:2G,swap:10%,state:rest"},
+		{"esp:1G,root:rest", "esp:1G,root:rest"},
+		{"esp:512M,root:2G:OTHER,state:rest", "esp:512M,root:2G:OTHER,state:rest"},
+	} {
+		s, err := ParseSpec(tt.in)
+		if err != nil {
+			t.Errorf("ParseSpec(%q): %v", tt.in, err)
+			continue
+		}
+		if got := s.String(); got != tt.want {
+			t.Errorf("ParseSpec(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	s, _ := ParseSpec("ab")
+	if p := s[s.Index(RoleBootB)]; p.Label != BootBName || p.Type != BootType {
+		t.Errorf("boot-b = %+v", p)
+	}
+}
+
+func TestParseSpecInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"state:1G,esp:512M", "must come first"},
+		{"esp:512M,boot-a:256M,state:rest", "go together"},
+		{"esp:512M,boot-a:256M,boot-b:256M,boot-b:256M", "more than one"},
+		{"esp:512M,boot-a:256M:MINE,boot-b:256M", "cannot change"},
+		{"esp:512M,state:1G:GOOS-VAR", "cannot change"},
+		{"esp:512M,root:rest,state:rest", "only one"},
+		{"esp:512M,root:60%,state:50%", "more than 100"},
+		{"esp:512M,var:1G", "unknown role"},
+		{"esp:0", "zero"},
+	} {
+		if _, err := ParseSpec(tt.in); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseSpec(%q) = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
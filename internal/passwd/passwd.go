@@ -0,0 +1,179 @@
+// Package passwd hashes and verifies root passwords in the SHA-512 crypt
+// ("$6$") format used by /etc/shadow, so installer configs never carry
+// the plaintext.
+package passwd
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	prefix        = "$6$"
+	defaultRounds = 5000
+	minRounds     = 1000
+	maxRounds     = 999999999
+	maxSaltLen    = 16
+	itoa64        = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errMalformed = errors.New("passwd: malformed SHA-512 crypt hash")
+
+// Hash returns the SHA-512 crypt hash of password with a random salt.
+func Hash(password string) (string, error) {
+	raw := make([]byte, maxSaltLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	salt := make([]byte, maxSaltLen)
+	for i, b := range raw {
+		salt[i] = itoa64[int(b)%len(itoa64)]
+	}
+	return crypt([]byte(password), salt, defaultRounds, false), nil
+}
+
+// IsHash reports whether s looks like a SHA-512 crypt hash rather than a
+// legacy plaintext password.
+func IsHash(s string) bool {
+	_, _, _, _, err := parse(s)
+	return err == nil
+}
+
+// Verify reports whether password matches hash. Only the digest is
+// compared: a rounds= value outside the allowed range is clamped, so the
+// hash crypt renders may spell it differently than the stored one.
+func Verify(hash, password string) bool {
+	salt, rounds, explicit, digest, err := parse(hash)
+	if err != nil {
+		return false
+	}
+	got := crypt([]byte(password), salt, rounds, explicit)
+	got = got[strings.LastIndexByte(got, '$')+1:]
+	return subtle.ConstantTimeCompare([]byte(got), []byte(digest)) == 1
+}
+
+// parse splits "$6$[rounds=N$]salt$digest".
+func parse(s string) (salt []byte, rounds int, explicit bool, digest string, err error) {
+	rest, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return nil, 0, false, "", errMalformed
+	}
+	rounds = defaultRounds
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, ok := strings.Cut(r, "$")
+		if !ok {
+			return nil, 0, false, "", errMalformed
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, 0, false, "", errMalformed
+		}
+		rounds = min(max(v, minRounds), maxRounds)
+		explicit = true
+		rest = after
+	}
+	saltStr, digest, ok := strings.Cut(rest, "$")
+	if !ok || len(digest) != 86 || len(saltStr) > maxSaltLen {
+		return nil, 0, false, "", errMalformed
+	}
+	return []byte(saltStr), rounds, explicit, digest, nil
+}
+
+// crypt implements the SHA-512 variant of Ulrich Drepper's SHA-crypt.
+func crypt(pw, salt []byte, rounds int, explicit bool) string {
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(salt)
+	b.Write(pw)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(salt)
+	n := len(pw)
+	for ; n > 64; n -= 64 {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n = len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(pw) {
+		dp.Write(pw)
+	}
+	p := repeat(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	for i := range rounds {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sumA)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sumA)
+		} else {
+			c.Write(p)
+		}
+		sumA = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(prefix)
+	if explicit {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+	for i := range 21 {
+		x, y, z := sumA[i], sumA[i+21], sumA[i+42]
+		switch i % 3 {
+		case 1:
+			x, y, z = y, z, x
+		case 2:
+			x, y, z = z, x, y
+		}
+		encode24(&out, x, y, z, 4)
+	}
+	encode24(&out, 0, 0, sumA[63], 2)
+	return out.String()
+}
+
+func repeat(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for ; n > len(sum); n -= len(sum) {
+		out = append(out, sum...)
+	}
+	return append(out, sum[:n]...)
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		out.WriteByte(itoa64[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,82 @@
+package passwd
+
+import (
+	"strings"
+	"testing"
+)
+
+// Vectors from Drepper's SHA-crypt specification, as shipped in glibc's
+// crypt/sha512c-test.c.
+var vectors = []struct {
+	setting, password, want string
+}{
+	{
+		"$6$saltstring", "Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	},
+	{
+		"$6$rounds=10000$saltstringsaltstring", "Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	},
+	{
+		"$6$rounds=5000$toolongsaltstring", "This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+	},
+	{
+		"$6$rounds=10$roundstoolow", "the minimum number is still observed",
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+	},
+}
+
+func TestCrypt(t *testing.T) {
+	for _, v := range vectors {
+		salt, rounds, explicit, _, err := parse(v.want)
+		if err != nil {
+			t.Fatalf("parse(%q): %v", v.want, err)
+		}
+		if got := crypt([]byte(v.password), salt, rounds, explicit); got != v.want {
+			t.Errorf("crypt(%q) = %q, want %q", v.setting, got, v.want)
+		}
+		if !Verify(v.want, v.password) {
+			t.Errorf("Verify(%q) failed", v.want)
+		}
+		if Verify(v.want, v.password+"x") {
+			t.Errorf("Verify(%q) accepted a wrong password", v.want)
+		}
+	}
+}
+
+func TestVerifyClampedRounds(t *testing.T) {
+	// A rounds value below the minimum is computed as 1000 but may be
+	// stored as written.
+	const hash = "$6$rounds=10$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."
+	if !Verify(hash, "the minimum number is still observed") {
+		t.Error("Verify with clamped rounds failed")
+	}
+}
+
+func TestHash(t *testing.T) {
+	h, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(h, prefix) || !IsHash(h) {
+		t.Fatalf("Hash = %q", h)
+	}
+	if !Verify(h, "secret") || Verify(h, "Secret") {
+		t.Errorf("Verify(%q) does not match its password", h)
+	}
+	if h2, _ := Hash("secret"); h2 == h {
+		t.Error("Hash reused a salt")
+	}
+	for _, s := range []string{
+		"", "secret", "$1$salt$digest", "$6$salt",
+		"$6$rounds=x$salt$" + strings.Repeat("a", 86),
+		"$6$salt$short",
+		"$6$saltsaltsaltsaltsalt$" + strings.Repeat("a", 86),
+	} {
+		if IsHash(s) || Verify(s, "") {
+			t.Errorf("IsHash(%q) = true", s)
+		}
+	}
+}
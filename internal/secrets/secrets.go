@@ -0,0 +1,153 @@
+// Package secrets seals installer secrets such as the join token so they
+// are not stored in cleartext on the ESP.
+//
+// Sealed values live in a single "secrets=v1:<base64>" config entry holding
+// an AES-256-GCM encrypted key=value block. The key is derived with HKDF
+// from, in order of preference, a QEMU fw_cfg blob, a goos.secret= cmdline
+// value, or a random per-node key kept on the ESP. The per-node key only
+// keeps secrets out of copies of the config file; fw_cfg keeps them off the
+// disk entirely.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vpereira/goos/internal/cmdline"
+	"github.com/vpereira/goos/internal/config"
+)
+
+const (
+	// ConfigKey is the config entry holding the sealed block.
+	ConfigKey = "secrets"
+	// NodeKeyPath is the per-node key file, relative to the ESP root.
+	NodeKeyPath = "/goos/node.key"
+	// FwCfgPath is the QEMU fw_cfg blob, set with
+	// -fw_cfg name=opt/goos/secret,string=....
+	FwCfgPath = "/sys/firmware/qemu_fw_cfg/by_name/opt/goos/secret/raw"
+	// RunDir is where goos-init exposes unsealed secrets at runtime.
+	RunDir = "/run/goos/secrets"
+
+	version = "v1"
+	info    = "goos secrets v1"
+)
+
+// Keys lists the config entries that are treated as secrets.
+var Keys = []string{"join_token"}
+
+// IsSecret reports whether key is sealed rather than stored in cleartext.
+func IsSecret(key string) bool {
+	for _, k := range Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Privileged reports whether key decides who may log in or what they may
+// run, holds a secret, or names where the node takes its metadata and
+// updates from: the ssh_* keys, the root password, the sealed block and
+// its secrets, metadata and update_*. Only the ESP config and unrestricted
+// callers may set these.
+func Privileged(key string) bool {
+	switch {
+	case strings.HasPrefix(key, "ssh_"), strings.HasPrefix(key, "update_"),
+		key == "root_password", key == "root_password_hash",
+		key == "metadata", key == ConfigKey, IsSecret(key):
+		return true
+	}
+	return false
+}
+
+// Redact hides a secret value in summaries and logs.
+func Redact(v string) string {
+	if v == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// ExternalKey returns key material supplied from outside the disk, from
+// fw_cfg or goos.secret=, and a short name for its source.
+func ExternalKey() ([]byte, string, bool) {
+	if b, err := os.ReadFile(FwCfgPath); err == nil && len(b) > 0 {
+		return b, "fw_cfg", true
+	}
+	if v, ok := cmdline.Value("goos.secret"); ok && v != "" {
+		return []byte(v), "cmdline", true
+	}
+	return nil, "", false
+}
+
+// NewNodeKey returns fresh key material for a per-node key file.
+func NewNodeKey() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// DeriveKey turns key material into an AES-256 key.
+func DeriveKey(material []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, material, nil, info, 32)
+}
+
+// Seal encrypts the given secrets into a value for the ConfigKey entry.
+func Seal(key []byte, s config.Config) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	var plain strings.Builder
+	for _, k := range s.Keys() {
+		fmt.Fprintf(&plain, "%s=%s\n", k, s[k])
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := aead.Seal(nonce, nonce, []byte(plain.String()), []byte(version))
+	return version + ":" + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Open decrypts a value produced by Seal.
+func Open(key []byte, sealed string) (config.Config, error) {
+	v, data, ok := strings.Cut(sealed, ":")
+	if !ok || v != version {
+		return nil, fmt.Errorf("secrets: unsupported format %q", v)
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("secrets: sealed block too short")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(version))
+	if err != nil {
+		return nil, errors.New("secrets: wrong key or corrupted block")
+	}
+	return config.Parse(strings.NewReader(string(plain)))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
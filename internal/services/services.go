@@ -0,0 +1,88 @@
+// Package services records the daemons goos-init starts so "goos services"
+// can report on them.
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dir holds one <name>.json status file per service.
+const Dir = "/run/goos/services"
+
+// States a service can be in.
+const (
+	Running  = "running"
+	Exited   = "exited"
+	Failed   = "failed"
+	Disabled = "disabled"
+)
+
+// Status is the last known state of a service.
+type Status struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	PID     int       `json:"pid,omitempty"`
+	Started time.Time `json:"started,omitzero"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Write records s, replacing the previous status of the service.
+func Write(s Status) error {
+	if err := os.MkdirAll(Dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(Dir, s.Name+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns every recorded service sorted by name. A running service
+// whose process is gone is reported as exited.
+func List() ([]Status, error) {
+	paths, err := filepath.Glob(filepath.Join(Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []Status
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var s Status
+		if err := json.Unmarshal(b, &s); err != nil {
+			continue
+		}
+		if s.State == Running && s.PID > 0 && !alive(s.PID) {
+			s.State = Exited
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// alive reports whether pid exists and is not a zombie.
+func alive(pid int) bool {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name.
+	s := string(b)
+	i := strings.LastIndexByte(s, ')')
+	return i < 0 || i+2 >= len(s) || s[i+2] != 'Z'
+}
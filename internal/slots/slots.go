@@ -0,0 +1,270 @@
+// Package slots names the A/B boot slots on the ESP and implements the
+// systemd-boot boot counting goos-init uses to bless a good boot.
+//
+// Each slot keeps its kernel and initramfs under /goos/<slot> and has a
+// loader entry goos-<slot>.conf. A freshly written slot's entry carries a
+// +LEFT-DONE counter (goos-a+3-0.conf); systemd-boot decrements LEFT on
+// every boot of it and sorts entries with no tries left to the end, so the
+// "default goos-*" glob falls back to the other slot. goos-init drops the
+// counter once the node is healthy.
+//
+// Hybrid installs also boot the slots from syslinux, which has no boot
+// counting: its config follows the slot goos-init last blessed.
+//
+// A layout with boot A/B partitions keeps a copy of each slot's last
+// blessed files on GOOS-BOOT-A and GOOS-BOOT-B. systemd-boot only reads
+// the ESP, so the slots still boot from there; goos-init restores a
+// blessed slot from its partition when the ESP copy is damaged.
+package slots
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/layout"
+)
+
+const (
+	// A and B are the two slots.
+	A = "a"
+	B = "b"
+	// Tries is how many boots a new slot gets to become healthy.
+	Tries = 3
+	// EntriesDir holds the loader entries, relative to the ESP root.
+	EntriesDir = "/loader/entries"
+	// LoaderConf selects the newest good slot.
+	LoaderConf = "default goos-*\ntimeout 0\neditor no\n"
+	// SyslinuxConf is the syslinux config of BIOS and hybrid installs,
+	// relative to the ESP root.
+	SyslinuxConf = "/syslinux/syslinux.cfg"
+)
+
+// Other returns the slot that is not s.
+func Other(s string) string {
+	if s == A {
+		return B
+	}
+	return A
+}
+
+// Dir is where a slot's boot files live, relative to the ESP root.
+func Dir(slot string) string { return "/goos/" + slot }
+
+// Kernel is a slot's kernel, relative to the ESP root.
+func Kernel(slot string) string { return Dir(slot) + "/vmlinuz" }
+
+// Initrd is a slot's initramfs, relative to the ESP root.
+func Initrd(slot string) string { return Dir(slot) + "/initramfs.cpio" }
+
+// Partition is the GPT name of slot's boot partition.
+func Partition(slot string) string {
+	if slot == B {
+		return layout.BootBName
+	}
+	return layout.BootAName
+}
+
+// Files are the slot files a boot partition keeps, at its root: the
+// kernel, the initramfs and the signed manifest covering them.
+var Files = []string{bundle.KernelName, bundle.InitrdName, bundle.SignatureName, bundle.ManifestName}
+
+// CopyFiles copies Files from the directory src to dst. The manifest is
+// removed first and written last, so a copy cut short never verifies.
+func CopyFiles(src, dst string) error {
+	if err := os.Remove(filepath.Join(dst, bundle.ManifestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, name := range Files {
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if serr := out.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// EntryName is the loader entry file name for slot. tries > 0 adds a boot
+// counter; 0 names a blessed entry.
+func EntryName(slot string, tries int) string {
+	if tries > 0 {
+		return fmt.Sprintf("goos-%s+%d-0.conf", slot, tries)
+	}
+	return "goos-" + slot + ".conf"
+}
+
+// EntryConf renders a slot's loader entry. systemd-boot boots the entry
+// with the highest version among those with tries left, so each write of a
+// slot gets a version above the other slot's.
+func EntryConf(slot string, version int, options string) string {
+	return "title GOOS (slot " + slot + ")\n" +
+		"sort-key goos\n" +
+		"version " + strconv.Itoa(version) + "\n" +
+		"linux " + Kernel(slot) + "\n" +
+		"initrd " + Initrd(slot) + "\n" +
+		"options " + options + " goos.slot=" + slot + "\n"
+}
+
+// Entry is a slot's loader entry as found on a mounted ESP.
+type Entry struct {
+	Slot    string
+	Path    string
+	Version int
+	// Counting is set while the entry still carries a boot counter; Left is
+	// then the number of tries systemd-boot has not used yet.
+	Counting bool
+	Left     int
+	Options  string
+}
+
+// Bad reports whether systemd-boot has given up on the entry.
+func (e Entry) Bad() bool { return e.Counting && e.Left == 0 }
+
+// Entries reads the slot entries under esp, newest version first.
+func Entries(esp string) ([]Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(esp, EntriesDir, "goos-*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	var list []Entry
+	for _, p := range paths {
+		e, ok := parseName(filepath.Base(p))
+		if !ok {
+			continue
+		}
+		e.Path = p
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			k, v, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch k {
+			case "version":
+				e.Version, _ = strconv.Atoi(strings.TrimSpace(v))
+			case "options":
+				e.Options = strings.TrimSpace(v)
+			}
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version > list[j].Version })
+	return list, nil
+}
+
+// Find returns slot's entry under esp.
+func Find(esp, slot string) (Entry, bool) {
+	list, _ := Entries(esp)
+	for _, e := range list {
+		if e.Slot == slot {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Bless drops the boot counter from slot's entry so systemd-boot keeps
+// booting it. It reports whether anything changed.
+func Bless(esp, slot string) (bool, error) {
+	e, ok := Find(esp, slot)
+	if !ok {
+		return false, fmt.Errorf("no loader entry for slot %s", slot)
+	}
+	if !e.Counting {
+		return false, nil
+	}
+	return true, os.Rename(e.Path, filepath.Join(esp, EntriesDir, EntryName(slot, 0)))
+}
+
+// PointSyslinux makes syslinux.cfg boot slot's kernel and initramfs. It
+// leaves alone an ESP without one, or one whose files are outside the
+// slots, and reports whether anything changed.
+func PointSyslinux(esp, slot string) (bool, error) {
+	path := filepath.Join(esp, SyslinuxConf)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	want := map[string]string{"LINUX": Kernel(slot), "INITRD": Initrd(slot)}
+	lines := strings.Split(string(b), "\n")
+	changed := false
+	for i, line := range lines {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		p, ok := want[strings.ToUpper(f[0])]
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(f[1], Dir(A)+"/") && !strings.HasPrefix(f[1], Dir(B)+"/") {
+			return false, nil
+		}
+		if f[1] != p {
+			lines[i] = strings.Replace(line, f[1], p, 1)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// parseName splits goos-<slot>[+LEFT[-DONE]].conf.
+func parseName(name string) (Entry, bool) {
+	base, ok := strings.CutSuffix(strings.TrimPrefix(name, "goos-"), ".conf")
+	if !ok {
+		return Entry{}, false
+	}
+	slot, counter, counting := strings.Cut(base, "+")
+	if slot != A && slot != B {
+		return Entry{}, false
+	}
+	e := Entry{Slot: slot, Counting: counting}
+	if counting {
+		left, _, _ := strings.Cut(counter, "-")
+		n, err := strconv.Atoi(left)
+		if err != nil {
+			return Entry{}, false
+		}
+		e.Left = n
+	}
+	return e, true
+}
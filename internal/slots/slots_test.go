@@ -0,0 +1,51 @@
+package slots
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/layout"
+)
+
+func TestCopyFiles(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, name := range Files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("new "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dst, bundle.ManifestName), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyFiles(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range Files {
+		b, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(b) != "new "+name {
+			t.Errorf("%s = %q, %v", name, b, err)
+		}
+	}
+	if m, _ := filepath.Glob(filepath.Join(dst, "*.tmp")); len(m) != 0 {
+		t.Errorf("left behind %v", m)
+	}
+
+	// A copy cut short leaves no manifest behind.
+	if err := os.Remove(filepath.Join(src, bundle.InitrdName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyFiles(src, dst); err == nil {
+		t.Fatal("CopyFiles with a missing file succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dst, bundle.ManifestName)); !os.IsNotExist(err) {
+		t.Errorf("manifest kept after a failed copy: %v", err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	if Partition(A) != layout.BootAName || Partition(B) != layout.BootBName {
+		t.Errorf("Partition = %q, %q", Partition(A), Partition(B))
+	}
+}
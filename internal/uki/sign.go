@@ -0,0 +1,288 @@
+package uki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+)
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSA             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSpcIndirectData = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcPEImageData  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+)
+
+// spcPEImageData is SpcPeImageData with no flags and an empty file link,
+// as every signing tool writes it.
+var spcPEImageData = []byte{0x30, 0x09, 0x03, 0x01, 0x00, 0xa0, 0x04, 0xa2, 0x02, 0x80, 0x00}
+
+type spcAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type spcIndirectData struct {
+	Data          spcAttribute
+	MessageDigest digestInfo
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version         int
+	IssuerAndSerial issuerAndSerial
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	AuthAttrs       asn1.RawValue
+	SignatureAlg    pkix.AlgorithmIdentifier
+	Signature       []byte
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+var (
+	sha256Alg = pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	rsaAlg    = pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+)
+
+// Sign returns image with an Authenticode signature by key, replacing any
+// signature it had. Firmware only accepts RSA keys, so cert must be one.
+func Sign(image []byte, key crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, errors.New("Secure Boot signing needs an RSA certificate")
+	}
+	f, err := parsePE(append([]byte(nil), image...))
+	if err != nil {
+		return nil, err
+	}
+	if off := f.u32(f.certDir); off != 0 && int(off) <= len(f.b) {
+		f.b = f.b[:off]
+	}
+	f.put32(f.certDir, 0)
+	f.put32(f.certDir+4, 0)
+	// The certificate table starts 8-byte aligned; the padding is hashed.
+	f.b = append(f.b, make([]byte, (8-len(f.b)%8)%8)...)
+
+	sig, err := signature(imageHash(f), key, cert)
+	if err != nil {
+		return nil, err
+	}
+	size := 8 + len(sig)
+	size += (8 - size%8) % 8
+	table := make([]byte, size)
+	binary.LittleEndian.PutUint32(table, uint32(size))
+	binary.LittleEndian.PutUint16(table[4:], 0x0200) // WIN_CERT_REVISION_2_0
+	binary.LittleEndian.PutUint16(table[6:], 0x0002) // WIN_CERT_TYPE_PKCS_SIGNED_DATA
+	copy(table[8:], sig)
+
+	off := len(f.b)
+	f.b = append(f.b, table...)
+	f.put32(f.certDir, uint32(off))
+	f.put32(f.certDir+4, uint32(size))
+	f.put32(f.checksum, checksum(f.b, f.checksum))
+	return f.b, nil
+}
+
+// imageHash is the Authenticode digest: the headers without the checksum
+// and certificate table entry, the sections in file order, then anything
+// after them up to the certificate table.
+func imageHash(f *peFile) []byte {
+	h := sha256.New()
+	hdr := int(f.sizeOfHeaders())
+	h.Write(f.b[:f.checksum])
+	h.Write(f.b[f.checksum+4 : f.certDir])
+	h.Write(f.b[f.certDir+8 : hdr])
+	type span struct{ off, size int }
+	var spans []span
+	for i := 0; i < f.nsections; i++ {
+		s := f.section(i)
+		if size := int(f.u32(s + 16)); size > 0 {
+			spans = append(spans, span{int(f.u32(s + 20)), size})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].off < spans[j].off })
+	hashed := hdr
+	for _, s := range spans {
+		h.Write(f.b[s.off : s.off+s.size])
+		hashed += s.size
+	}
+	end := len(f.b)
+	if off := int(f.u32(f.certDir)); off != 0 {
+		end = off
+	}
+	if hashed < end {
+		h.Write(f.b[hashed:end])
+	}
+	return h.Sum(nil)
+}
+
+// signature builds the PKCS#7 SignedData over an SpcIndirectDataContent
+// carrying digest.
+func signature(digest []byte, key crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	indirect, err := asn1.Marshal(spcIndirectData{
+		Data:          spcAttribute{Type: oidSpcPEImageData, Value: asn1.RawValue{FullBytes: spcPEImageData}},
+		MessageDigest: digestInfo{Algorithm: sha256Alg, Digest: digest},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The message digest covers the content without its SEQUENCE header.
+	var body asn1.RawValue
+	if _, err := asn1.Unmarshal(indirect, &body); err != nil {
+		return nil, err
+	}
+	contentDigest := sha256.Sum256(body.Bytes)
+
+	ctype, err := asn1.Marshal(oidSpcIndirectData)
+	if err != nil {
+		return nil, err
+	}
+	mdigest, err := asn1.Marshal(contentDigest[:])
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, a := range []attribute{
+		{Type: oidContentType, Values: set(ctype)},
+		{Type: oidMessageDigest, Values: set(mdigest)},
+	} {
+		b, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, b)
+	}
+	authAttrs := setOf(attrs)
+	signed, err := asn1.Marshal(set(authAttrs))
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(signed)
+	sig, err := key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	si, err := asn1.Marshal(signerInfo{
+		Version:         1,
+		IssuerAndSerial: issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+		DigestAlgorithm: sha256Alg,
+		AuthAttrs:       context0(authAttrs),
+		SignatureAlg:    rsaAlg,
+		Signature:       sig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	algs, err := asn1.Marshal(sha256Alg)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: set(algs),
+		ContentInfo:      contentInfo{ContentType: oidSpcIndirectData, Content: context0(indirect)},
+		Certificates:     context0(cert.Raw),
+		SignerInfos:      set(si),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: context0(sd)})
+}
+
+// set wraps DER elements in a SET.
+func set(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b}
+}
+
+// setOf concatenates elements in DER SET OF order.
+func setOf(elems [][]byte) []byte {
+	sort.Slice(elems, func(i, j int) bool { return string(elems[i]) < string(elems[j]) })
+	var out []byte
+	for _, e := range elems {
+		out = append(out, e...)
+	}
+	return out
+}
+
+// context0 wraps DER elements in a [0] context tag.
+func context0(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+}
+
+// LoadSigner reads a PEM private key (PKCS#1 or PKCS#8) and certificate,
+// as used for the Secure Boot db.
+func LoadSigner(keyPath, certPath string) (crypto.Signer, *x509.Certificate, error) {
+	kb, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(kb)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM key", keyPath)
+	}
+	var key crypto.Signer
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		s, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: unsupported key", keyPath)
+		}
+		key = s
+	} else {
+		return nil, nil, fmt.Errorf("%s: unsupported key", keyPath)
+	}
+	cb, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(cb)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM certificate", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	return key, cert, nil
+}
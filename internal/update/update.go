@@ -0,0 +1,378 @@
+// Package update fetches update bundles and stages them into the inactive
+// boot slot on the ESP.
+//
+// An update is a signed bundle (see package bundle) served over HTTP as a
+// directory with vmlinuz, initramfs.cpio and an optional entry.conf, a
+// loader entry of which only the options line is used.
+package update
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/slots"
+)
+
+// Client downloads bundles from BaseURL. Manifests must carry a valid
+// signature by PublicKey.
+type Client struct {
+	BaseURL   string
+	PublicKey ed25519.PublicKey
+	HTTP      *http.Client
+	// AllowDowngrade lets Stage install a bundle older than the installed
+	// ones. Without it an old, validly signed bundle replayed by the
+	// server is refused.
+	AllowDowngrade bool
+}
+
+// Manifest fetches the bundle manifest and checks its signature. It
+// returns the raw manifest too, for keeping next to the staged files.
+func (c *Client) Manifest(ctx context.Context) (*bundle.Manifest, []byte, []byte, error) {
+	if c.PublicKey == nil {
+		return nil, nil, nil, errors.New("no trust root to verify bundles with")
+	}
+	raw, err := c.get(ctx, bundle.ManifestName, 1<<20)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sig, err := c.get(ctx, bundle.SignatureName, 4096)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := bundle.Verify(c.PublicKey, raw, sig); err != nil {
+		return nil, nil, nil, err
+	}
+	m, err := bundle.Parse(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return m, raw, sig, nil
+}
+
+// Fetch downloads a bundle file to dst, checking it against m.
+func (c *Client) Fetch(ctx context.Context, m *bundle.Manifest, name, dst string) error {
+	want, ok := m.Files[name]
+	if !ok {
+		return fmt.Errorf("%s not in manifest", name)
+	}
+	resp, err := c.do(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = m.Check(name, io.TeeReader(io.LimitReader(resp.Body, want.Size+1), f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+	return err
+}
+
+func (c *Client) get(ctx context.Context, name string, limit int64) ([]byte, error) {
+	resp, err := c.do(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+func (c *Client) do(ctx context.Context, name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.BaseURL, "/")+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", name, resp.Status)
+	}
+	return resp, nil
+}
+
+// Result reports what Stage did.
+type Result struct {
+	Booted  string `json:"booted_slot"`
+	Slot    string `json:"slot,omitempty"`
+	Version string `json:"version"`
+	// Staged is set when a new version was written; UpToDate when the
+	// booted or already staged slot has it.
+	Staged   bool `json:"staged"`
+	UpToDate bool `json:"up_to_date"`
+}
+
+// Stage writes the bundle's version into the slot that is not booted and
+// gives it the newest loader entry, on trial for slots.Tries boots. The
+// old entry of that slot is removed first, so a half-written slot is never
+// booted, and syslinux on a hybrid install is pointed at the booted slot
+// first. Versions only move forward unless c.AllowDowngrade is set.
+//
+// A bundle only carries the kernel and initramfs, so Stage refuses slots
+// that switch into an ext4 root or a root image: the userland there would
+// stay at the installed version.
+func Stage(ctx context.Context, c *Client, esp, booted string) (Result, error) {
+	res := Result{Booted: booted}
+	m, raw, sig, err := c.Manifest(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.Version = m.Version
+	target := slots.Other(booted)
+	if InstalledVersion(esp, booted) == m.Version {
+		res.UpToDate = true
+		return res, nil
+	}
+	res.Slot = target
+	if e, ok := slots.Find(esp, target); ok && InstalledVersion(esp, target) == m.Version {
+		if e.Bad() {
+			return res, fmt.Errorf("version %s failed to boot in slot %s", m.Version, target)
+		}
+		res.UpToDate = true
+		return res, nil
+	}
+	cur, ok := slots.Find(esp, booted)
+	if !ok {
+		return res, fmt.Errorf("no loader entry for booted slot %s", booted)
+	}
+	if root, ok := rootOption(cur.Options); ok {
+		return res, fmt.Errorf("slot %s boots %s, which updates do not replace; reinstall to update this node", booted, root)
+	}
+	if !c.AllowDowngrade {
+		if err := checkNewer(esp, booted, m.Version); err != nil {
+			return res, err
+		}
+	}
+
+	if _, err := slots.PointSyslinux(esp, booted); err != nil {
+		return res, fmt.Errorf("syslinux: %w", err)
+	}
+	if e, ok := slots.Find(esp, target); ok {
+		if err := os.Remove(e.Path); err != nil {
+			return res, err
+		}
+	}
+	dir := filepath.Join(esp, slots.Dir(target))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return res, err
+	}
+	_ = os.Remove(filepath.Join(dir, bundle.ManifestName))
+	for name, dst := range map[string]string{
+		bundle.KernelName: filepath.Join(esp, slots.Kernel(target)),
+		bundle.InitrdName: filepath.Join(esp, slots.Initrd(target)),
+	} {
+		if err := c.Fetch(ctx, m, name, dst+".tmp"); err != nil {
+			return res, err
+		}
+		if err := os.Rename(dst+".tmp", dst); err != nil {
+			return res, err
+		}
+	}
+	options := cur.Options
+	if _, ok := m.Files[bundle.EntryName]; ok {
+		tmp := filepath.Join(dir, bundle.EntryName+".tmp")
+		if err := c.Fetch(ctx, m, bundle.EntryName, tmp); err != nil {
+			return res, err
+		}
+		b, err := os.ReadFile(tmp)
+		_ = os.Remove(tmp)
+		if err != nil {
+			return res, err
+		}
+		if o := entryOptions(string(b)); o != "" {
+			options = carryOptions(o, cur.Options)
+		}
+	}
+	// The signed manifest stays with the slot so goos-init can check the
+	// files again before blessing it.
+	if err := os.WriteFile(filepath.Join(dir, bundle.SignatureName), sig, 0o644); err != nil {
+		return res, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundle.ManifestName), raw, 0o644); err != nil {
+		return res, err
+	}
+	entry := slots.EntryConf(target, nextVersion(esp), stripOption(options, "goos.slot"))
+	path := filepath.Join(esp, slots.EntriesDir, slots.EntryName(target, slots.Tries))
+	if err := os.WriteFile(path, []byte(entry), 0o644); err != nil {
+		return res, err
+	}
+	res.Staged = true
+	return res, nil
+}
+
+// Pending returns the slot systemd-boot will pick next when that is not the
+// booted one.
+func Pending(esp, booted string) (string, bool) {
+	list, err := slots.Entries(esp)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range list {
+		if e.Bad() {
+			continue
+		}
+		return e.Slot, e.Slot != booted
+	}
+	return "", false
+}
+
+// InstalledVersion is the bundle version written to slot, or "" for a slot
+// written by the installer.
+func InstalledVersion(esp, slot string) string {
+	b, err := os.ReadFile(filepath.Join(esp, slots.Dir(slot), bundle.ManifestName))
+	if err != nil {
+		return ""
+	}
+	m, err := bundle.Parse(b)
+	if err != nil {
+		return ""
+	}
+	return m.Version
+}
+
+// checkNewer refuses a bundle version older than the booted slot's, or
+// than a healthy staged one in the other slot.
+func checkNewer(esp, booted, version string) error {
+	for _, slot := range []string{booted, slots.Other(booted)} {
+		if e, ok := slots.Find(esp, slot); !ok || e.Bad() {
+			continue
+		}
+		if v := InstalledVersion(esp, slot); v != "" && CompareVersions(version, v) < 0 {
+			return fmt.Errorf("version %s is older than %s in slot %s", version, v, slot)
+		}
+	}
+	return nil
+}
+
+// CompareVersions orders bundle versions the way dpkg does, comparing runs
+// of digits numerically and everything else byte by byte, so 1.10 comes
+// after 1.9. It returns -1, 0 or +1.
+func CompareVersions(a, b string) int {
+	for a != "" || b != "" {
+		var x, y string
+		x, a = versionRun(a)
+		y, b = versionRun(b)
+		if c := compareRun(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// versionRun splits off the leading run of digits or of non-digits.
+func versionRun(s string) (string, string) {
+	if s == "" {
+		return "", ""
+	}
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func compareRun(x, y string) int {
+	if x != "" && y != "" && isDigit(x[0]) && isDigit(y[0]) {
+		x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+		if len(x) != len(y) {
+			return cmp.Compare(len(x), len(y))
+		}
+	}
+	return strings.Compare(x, y)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func nextVersion(esp string) int {
+	v := 0
+	list, _ := slots.Entries(esp)
+	for _, e := range list {
+		v = max(v, e.Version)
+	}
+	return v + 1
+}
+
+func entryOptions(conf string) string {
+	for _, line := range strings.Split(conf, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "options "); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// carryOptions keeps the node's own root settings, which a bundle cannot
+// know, unless the bundle's options set them.
+func carryOptions(bundle, node string) string {
+	out := bundle
+	for _, f := range strings.Fields(node) {
+		k, _, _ := strings.Cut(f, "=")
+		if k != "root" && !strings.HasPrefix(k, "goos.root") {
+			continue
+		}
+		if !hasOption(bundle, k) {
+			out += " " + f
+		}
+	}
+	return out
+}
+
+// rootOption returns the option that makes goos-init switch out of the
+// initramfs, goos.root= before root= as goos-init reads them.
+func rootOption(options string) (string, bool) {
+	var root string
+	for _, f := range strings.Fields(options) {
+		k, v, _ := strings.Cut(f, "=")
+		switch {
+		case v == "":
+		case k == "goos.root":
+			return f, true
+		case k == "root" && root == "":
+			root = f
+		}
+	}
+	return root, root != ""
+}
+
+func hasOption(options, key string) bool {
+	for _, f := range strings.Fields(options) {
+		if k, _, _ := strings.Cut(f, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func stripOption(options, key string) string {
+	var out []string
+	for _, f := range strings.Fields(options) {
+		if k, _, _ := strings.Cut(f, "="); k != key {
+			out = append(out, f)
+		}
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,340 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vpereira/goos/internal/bundle"
+	"github.com/vpereira/goos/internal/slots"
+)
+
+// testBundle is a signed bundle served over HTTP.
+type testBundle struct {
+	files map[string][]byte
+	pub   ed25519.PublicKey
+}
+
+func newBundle(t *testing.T, version string, files map[string][]byte) *testBundle {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var names []string
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	raw, err := bundle.Create(dir, version, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := map[string][]byte{bundle.ManifestName: raw, bundle.SignatureName: bundle.Sign(priv, raw)}
+	for name, b := range files {
+		served[name] = b
+	}
+	return &testBundle{files: served, pub: pub}
+}
+
+func bootFiles(tag string) map[string][]byte {
+	return map[string][]byte{
+		bundle.KernelName: []byte("kernel " + tag),
+		bundle.InitrdName: []byte("initramfs " + tag),
+	}
+}
+
+func (b *testBundle) client(t *testing.T) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := b.files[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(f)
+	}))
+	t.Cleanup(srv.Close)
+	return &Client{BaseURL: srv.URL, PublicKey: b.pub, HTTP: srv.Client()}
+}
+
+// newESP lays out an ESP booted from blessed slot a with version, and an
+// older blessed slot b, running from the initramfs.
+func newESP(t *testing.T, version string) string {
+	t.Helper()
+	return newESPOptions(t, version, "console=ttyS0")
+}
+
+func newESPOptions(t *testing.T, version, options string) string {
+	t.Helper()
+	esp := t.TempDir()
+	mkdir(t, filepath.Join(esp, slots.EntriesDir))
+	mkdir(t, filepath.Join(esp, slots.Dir(slots.A)))
+	writeFile(t, filepath.Join(esp, slots.Dir(slots.A), bundle.ManifestName),
+		`{"version": "`+version+`", "files": {"vmlinuz": {}, "initramfs.cpio": {}}}`)
+	writeFile(t, filepath.Join(esp, slots.EntriesDir, slots.EntryName(slots.A, 0)),
+		slots.EntryConf(slots.A, 2, options))
+	writeFile(t, filepath.Join(esp, slots.EntriesDir, slots.EntryName(slots.B, 0)),
+		slots.EntryConf(slots.B, 1, options))
+	return esp
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, path, s string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStage(t *testing.T) {
+	esp := newESP(t, "1.0")
+	files := bootFiles("1.1")
+	files[bundle.EntryName] = []byte("title x\noptions console=tty0 quiet\n")
+	c := newBundle(t, "1.1", files).client(t)
+
+	res, err := Stage(context.Background(), c, esp, slots.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Staged || res.Slot != slots.B || res.Version != "1.1" {
+		t.Fatalf("Stage = %+v", res)
+	}
+	b, err := os.ReadFile(filepath.Join(esp, slots.Kernel(slots.B)))
+	if err != nil || string(b) != "kernel 1.1" {
+		t.Fatalf("staged kernel = %q, %v", b, err)
+	}
+	e, ok := slots.Find(esp, slots.B)
+	if !ok || !e.Counting || e.Left != slots.Tries || e.Version != 3 {
+		t.Fatalf("slot b entry = %+v", e)
+	}
+	if want := "console=tty0 quiet goos.slot=b"; e.Options != want {
+		t.Errorf("options = %q, want %q", e.Options, want)
+	}
+	if v := InstalledVersion(esp, slots.B); v != "1.1" {
+		t.Errorf("InstalledVersion = %q", v)
+	}
+	if slot, ok := Pending(esp, slots.A); !ok || slot != slots.B {
+		t.Errorf("Pending = %q, %v", slot, ok)
+	}
+
+	// Checking again finds the staged slot.
+	res, err = Stage(context.Background(), c, esp, slots.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Staged || !res.UpToDate || res.Slot != slots.B {
+		t.Fatalf("second Stage = %+v", res)
+	}
+}
+
+func TestStageBooted(t *testing.T) {
+	esp := newESP(t, "1.0")
+	c := newBundle(t, "1.0", bootFiles("1.0")).client(t)
+	res, err := Stage(context.Background(), c, esp, slots.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Staged || !res.UpToDate {
+		t.Fatalf("Stage = %+v", res)
+	}
+	if _, ok := Pending(esp, slots.A); ok {
+		t.Error("Pending with nothing staged")
+	}
+}
+
+func TestStageBadSlot(t *testing.T) {
+	esp := newESP(t, "1.0")
+	c := newBundle(t, "1.1", bootFiles("1.1")).client(t)
+	if _, err := Stage(context.Background(), c, esp, slots.A); err != nil {
+		t.Fatal(err)
+	}
+	// systemd-boot used up the tries without a blessing.
+	e, _ := slots.Find(esp, slots.B)
+	if err := os.Rename(e.Path, filepath.Join(esp, slots.EntriesDir, "goos-b+0-3.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if slot, ok := Pending(esp, slots.A); ok {
+		t.Errorf("Pending = %q with slot b bad", slot)
+	}
+	_, err := Stage(context.Background(), c, esp, slots.A)
+	if err == nil || !strings.Contains(err.Error(), "failed to boot") {
+		t.Fatalf("Stage of a failed version: %v", err)
+	}
+}
+
+func TestStageSyslinux(t *testing.T) {
+	esp := newESP(t, "1.0")
+	mkdir(t, filepath.Join(esp, "syslinux"))
+	conf := filepath.Join(esp, slots.SyslinuxConf)
+	writeFile(t, conf, "DEFAULT goos\nLABEL goos\n  LINUX /goos/b/vmlinuz\n  INITRD /goos/b/initramfs.cpio\n  APPEND console=ttyS0\n")
+
+	// Syslinux is moved off slot b before it is overwritten.
+	c := newBundle(t, "1.1", bootFiles("1.1")).client(t)
+	if _, err := Stage(context.Background(), c, esp, slots.A); err != nil {
+		t.Fatal(err)
+	}
+	want := "DEFAULT goos\nLABEL goos\n  LINUX /goos/a/vmlinuz\n  INITRD /goos/a/initramfs.cpio\n  APPEND console=ttyS0\n"
+	if b, _ := os.ReadFile(conf); string(b) != want {
+		t.Errorf("syslinux.cfg = %q, want %q", b, want)
+	}
+
+	// goos-init moves it on once slot b is blessed.
+	if changed, err := slots.PointSyslinux(esp, slots.B); err != nil || !changed {
+		t.Fatalf("PointSyslinux = %v, %v", changed, err)
+	}
+	if changed, err := slots.PointSyslinux(esp, slots.B); err != nil || changed {
+		t.Fatalf("second PointSyslinux = %v, %v", changed, err)
+	}
+
+	// A BIOS install's own copy is left alone.
+	writeFile(t, conf, "LINUX /goos/bios/vmlinuz\nINITRD /goos/bios/initramfs.cpio\n")
+	if changed, err := slots.PointSyslinux(esp, slots.A); err != nil || changed {
+		t.Fatalf("PointSyslinux on a BIOS install = %v, %v", changed, err)
+	}
+}
+
+func TestStageExt4Root(t *testing.T) {
+	for _, options := range []string{
+		"console=ttyS0 root=PARTUUID=1234",
+		"console=ttyS0 goos.root=auto",
+		"console=ttyS0 root= goos.root=squashfs:/goos/root.img",
+	} {
+		esp := newESPOptions(t, "1.0", options)
+		c := newBundle(t, "1.1", bootFiles("1.1")).client(t)
+		_, err := Stage(context.Background(), c, esp, slots.A)
+		if err == nil || !strings.Contains(err.Error(), "updates do not replace") {
+			t.Errorf("Stage with %q: %v", options, err)
+		}
+		if e, ok := slots.Find(esp, slots.B); !ok || e.Counting {
+			t.Errorf("slot b touched: %+v", e)
+		}
+		if _, err := os.Stat(filepath.Join(esp, slots.Kernel(slots.B))); !os.IsNotExist(err) {
+			t.Errorf("slot b kernel written: %v", err)
+		}
+	}
+
+	// Empty root options leave the node in the initramfs.
+	esp := newESPOptions(t, "1.0", "console=ttyS0 root= goos.root= goos.root.overlay=0")
+	c := newBundle(t, "1.1", bootFiles("1.1")).client(t)
+	if res, err := Stage(context.Background(), c, esp, slots.A); err != nil || !res.Staged {
+		t.Fatalf("Stage = %+v, %v", res, err)
+	}
+}
+
+func TestStageBadSignature(t *testing.T) {
+	esp := newESP(t, "1.0")
+	b := newBundle(t, "1.1", bootFiles("1.1"))
+	c := b.client(t)
+	c.PublicKey = newBundle(t, "1.1", nil).pub
+	if _, err := Stage(context.Background(), c, esp, slots.A); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("Stage with the wrong key: %v", err)
+	}
+	if e, ok := slots.Find(esp, slots.B); !ok || e.Counting {
+		t.Errorf("slot b touched: %+v", e)
+	}
+
+	c.PublicKey = nil
+	if _, err := Stage(context.Background(), c, esp, slots.A); err == nil {
+		t.Fatal("Stage without a trust root succeeded")
+	}
+}
+
+func TestStageDowngrade(t *testing.T) {
+	esp := newESP(t, "1.10")
+	c := newBundle(t, "1.9", bootFiles("1.9")).client(t)
+	if _, err := Stage(context.Background(), c, esp, slots.A); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Fatalf("Stage of an older version: %v", err)
+	}
+	c.AllowDowngrade = true
+	res, err := Stage(context.Background(), c, esp, slots.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Staged {
+		t.Fatalf("Stage with AllowDowngrade = %+v", res)
+	}
+}
+
+func TestFetchMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		served string
+		want   string
+	}{
+		{"short", "kernel", "got 6 bytes"},
+		{"long", "kernel 1.1 and more", "got 11 bytes"},
+		{"digest", "kernel 9.9", "SHA-256 mismatch"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBundle(t, "1.1", bootFiles("1.1"))
+			c := b.client(t)
+			m, _, _, err := c.Manifest(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.files[bundle.KernelName] = []byte(tt.served)
+			dst := filepath.Join(t.TempDir(), "vmlinuz")
+			err = c.Fetch(context.Background(), m, bundle.KernelName, dst)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Fetch = %v, want %q", err, tt.want)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Errorf("%s left behind: %v", dst, err)
+			}
+		})
+	}
+}
+
+func TestFetchNotFound(t *testing.T) {
+	b := newBundle(t, "1.1", bootFiles("1.1"))
+	c := b.client(t)
+	m, _, _, err := c.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(b.files, bundle.InitrdName)
+	if err := c.Fetch(context.Background(), m, bundle.InitrdName, filepath.Join(t.TempDir(), "x")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Fetch of a missing file = %v", err)
+	}
+	if err := c.Fetch(context.Background(), m, "other", filepath.Join(t.TempDir(), "x")); err == nil {
+		t.Fatal("Fetch of a file not in the manifest succeeded")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.9", "1.10", -1},
+		{"1.2", "1.2.1", -1},
+		{"2", "10", -1},
+		{"1.01", "1.1", 0},
+		{"20261018", "20261017", 1},
+		{"v1.2", "v1.3", -1},
+	} {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}